@@ -8,5 +8,6 @@ require (
 	github.com/spf13/afero v1.1.2
 	github.com/stretchr/testify v1.7.0
 	go.k6.io/k6 v0.33.1-0.20210825161650-c932a28ff940
+	golang.org/x/time v0.0.0-20210611083556-38a9dc6acbc6
 	gopkg.in/guregu/null.v3 v3.3.0
 )
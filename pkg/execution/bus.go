@@ -0,0 +1,50 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package execution
+
+import "sync"
+
+// messageBus keeps the latest message published to each topic on this k6
+// instance. Messages are stored JSON-encoded, so that every VU gets its own
+// copy and VUs never share goja values.
+type messageBus struct {
+	mu       sync.RWMutex
+	messages map[string][]byte
+}
+
+func newMessageBus() *messageBus {
+	return &messageBus{messages: make(map[string][]byte)}
+}
+
+// publish replaces the latest message for topic.
+func (mb *messageBus) publish(topic string, msg []byte) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.messages[topic] = msg
+}
+
+// latest returns the last message published to topic, if any.
+func (mb *messageBus) latest(topic string) ([]byte, bool) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	msg, ok := mb.messages[topic]
+	return msg, ok
+}
@@ -21,28 +21,58 @@
 package execution
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/dop251/goja"
+	"gopkg.in/guregu/null.v3"
 
 	"go.k6.io/k6/js/common"
 	"go.k6.io/k6/js/modules"
 	"go.k6.io/k6/lib"
+	"go.k6.io/k6/lib/consts"
+	"go.k6.io/k6/lib/executor"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/stats"
 )
 
 type (
 	// RootModule is the global module instance that will create module
 	// instances for each VU.
-	RootModule struct{}
+	RootModule struct {
+		bus        *messageBus
+		metrics    *metricRegistry
+		sequences  *sequences
+		limiters   *rateLimiters
+		barriers   *barriers
+		semaphores *semaphores
+		onces      *onces
+		vus        *vuRegistry
+	}
 
 	// ModuleInstance represents an instance of the execution module.
 	ModuleInstance struct {
 		modules.InstanceCore
-		obj *goja.Object
+		root *RootModule
+		obj  *goja.Object
+		vu   *vuData
 	}
 )
 
+// vuUUIDNamespace is the namespace of the version 5 UUIDs of the VUs.
+var vuUUIDNamespace = [16]byte{
+	0x49, 0xf4, 0x5b, 0x53, 0x61, 0x8d, 0x4f, 0x22,
+	0xae, 0xf0, 0x53, 0x99, 0x59, 0xde, 0xa9, 0xbc,
+}
+
 var (
 	_ modules.IsModuleV2 = &RootModule{}
 	_ modules.Instance   = &ModuleInstance{}
@@ -50,14 +80,26 @@ var (
 
 // New returns a pointer to a new RootModule instance.
 func New() *RootModule {
-	return &RootModule{}
+	return &RootModule{
+		bus:        newMessageBus(),
+		metrics:    newMetricRegistry(),
+		sequences:  newSequences(),
+		limiters:   newRateLimiters(),
+		barriers:   newBarriers(),
+		semaphores: newSemaphores(),
+		onces:      newOnces(),
+		vus:        newVURegistry(),
+	}
 }
 
 // NewModuleInstance implements the modules.IsModuleV2 interface to return
 // a new instance for each VU.
-func (*RootModule) NewModuleInstance(m modules.InstanceCore) modules.Instance {
-	mi := &ModuleInstance{InstanceCore: m}
+func (rm *RootModule) NewModuleInstance(m modules.InstanceCore) modules.Instance {
+	// A module instance is created for every module of the script that
+	// requires this one, when the VU's init context runs. The state they
+	// share is kept per VU in the root module.
 	rt := m.GetRuntime()
+	mi := &ModuleInstance{InstanceCore: m, root: rm, vu: rm.vus.get(rt)}
 	o := rt.NewObject()
 	defProp := func(name string, newInfo func() (*goja.Object, error)) {
 		err := o.DefineAccessorProperty(name, rt.ToValue(func() goja.Value {
@@ -74,6 +116,44 @@ func (*RootModule) NewModuleInstance(m modules.InstanceCore) modules.Instance {
 	defProp("scenario", mi.newScenarioInfo)
 	defProp("instance", mi.newInstanceInfo)
 	defProp("vu", mi.newVUInfo)
+	defProp("test", mi.newTestInfo)
+
+	defFunc := func(name string, fn interface{}) {
+		if err := o.Set(name, fn); err != nil {
+			common.Throw(rt, err)
+		}
+	}
+	defFunc("publish", mi.publish)
+	defFunc("subscribe", mi.subscribe)
+	defFunc("emitGauge", mi.emitGauge)
+	defFunc("emitHistogram", mi.emitHistogram)
+	defFunc("assert", mi.assert)
+	defFunc("newTrend", mi.newMetricConstructor(stats.Trend))
+	defFunc("newCounter", mi.newMetricConstructor(stats.Counter))
+	defFunc("newGauge", mi.newMetricConstructor(stats.Gauge))
+	defFunc("beginPhase", mi.beginPhase)
+	defFunc("endPhase", mi.endPhase)
+	defFunc("claimSequence", mi.claimSequence)
+	defFunc("rateLimit", mi.rateLimit)
+	defFunc("barrier", mi.barrier)
+	defFunc("concurrency", mi.concurrency)
+	defFunc("onceScenario", mi.onceScenario)
+	defFunc("withTags", mi.withTags)
+	defFunc("retry", mi.retry)
+	defFunc("lifecyclePhase", mi.lifecyclePhase)
+	defFunc("random", mi.random)
+	defFunc("randomInt", mi.randomInt)
+
+	timeObj := rt.NewObject()
+	if err := timeObj.Set("elapsed", mi.elapsed); err != nil {
+		common.Throw(rt, err)
+	}
+	if err := timeObj.Set("remaining", mi.remaining); err != nil {
+		common.Throw(rt, err)
+	}
+	if err := o.Set("time", timeObj); err != nil {
+		common.Throw(rt, err)
+	}
 
 	mi.obj = o
 
@@ -90,8 +170,9 @@ func (mi *ModuleInstance) GetExports() modules.Exports {
 func (mi *ModuleInstance) newScenarioInfo() (*goja.Object, error) {
 	ctx := mi.GetContext()
 	vuState := lib.GetState(ctx)
+	es := lib.GetExecutionState(ctx)
 	ss := lib.GetScenarioState(ctx)
-	if ss == nil || vuState == nil {
+	if ss == nil || vuState == nil || es == nil {
 		return nil, errors.New("getting scenario information in the init context is not supported")
 	}
 
@@ -111,6 +192,9 @@ func (mi *ModuleInstance) newScenarioInfo() (*goja.Object, error) {
 			ss := lib.GetScenarioState(ctx)
 			return ss.Executor
 		},
+		"index": func() interface{} {
+			return scenarioIndex(vuState.Options.Scenarios, ss.Name)
+		},
 		"startTime": func() interface{} {
 			// Return the timestamp in milliseconds, since that's how JS
 			// timestamps usually are:
@@ -118,6 +202,47 @@ func (mi *ModuleInstance) newScenarioInfo() (*goja.Object, error) {
 			// https://developer.mozilla.org/en-US/docs/Web/JavaScript/Reference/Global_Objects/Date/now#return_value
 			return ss.StartTime.UnixNano() / int64(time.Millisecond)
 		},
+		"startOffset": func() interface{} {
+			var offset time.Duration
+			if cfg, ok := vuState.Options.Scenarios[ss.Name]; ok {
+				offset = cfg.GetStartTime()
+			}
+			return float64(offset) / float64(time.Millisecond)
+		},
+		"vusMax": func() interface{} {
+			if cfg, ok := vuState.Options.Scenarios[ss.Name]; ok {
+				return maxVUs(cfg, es.ExecutionTuple)
+			}
+			return nil
+		},
+		"status": func() interface{} {
+			cfg, ok := vuState.Options.Scenarios[ss.Name]
+			if !ok {
+				return "running"
+			}
+			return scenarioStatus(cfg, es.ExecutionTuple, ss.StartTime)
+		},
+		"relativeWeight": func() interface{} {
+			return relativeWeight(vuState.Options.Scenarios, ss.Name, es.ExecutionTuple)
+		},
+		"currentTarget": func() interface{} {
+			target, _ := currentTarget(vuState.Options.Scenarios[ss.Name], es.ExecutionTuple, time.Since(ss.StartTime))
+			return target
+		},
+		"currentTargetUnit": func() interface{} {
+			_, unit := currentTarget(vuState.Options.Scenarios[ss.Name], es.ExecutionTuple, time.Since(ss.StartTime))
+			return unit
+		},
+		"gracefulRampDown": func() interface{} {
+			cfg, ok := vuState.Options.Scenarios[ss.Name].(executor.RampingVUsConfig)
+			if !ok {
+				return nil
+			}
+			return float64(cfg.GracefulRampDown.Duration) / float64(time.Millisecond)
+		},
+		"effectiveTags": func() interface{} {
+			return effectiveTags(vuState.Options, ss.Name)
+		},
 		"progress": func() interface{} {
 			p, _ := ss.ProgressFn()
 			return p
@@ -125,6 +250,15 @@ func (mi *ModuleInstance) newScenarioInfo() (*goja.Object, error) {
 		"iterationInInstance": func() interface{} {
 			return vuState.GetScenarioLocalVUIter()
 		},
+		"iterationsRemaining": func() interface{} {
+			total, ok := totalIterations(vuState.Options.Scenarios[ss.Name], es.ExecutionTuple)
+			if !ok {
+				return nil
+			}
+			// This is as of the start of the current iteration: iterations
+			// other VUs started since then are still counted.
+			return total - int64(vuState.GetScenarioLocalVUIter()) - 1
+		},
 		"iterationInTest": func() interface{} {
 			return vuState.GetScenarioGlobalVUIter()
 		},
@@ -163,6 +297,65 @@ func (mi *ModuleInstance) newInstanceInfo() (*goja.Object, error) {
 		"vusInitialized": func() interface{} {
 			return es.GetInitializedVUsCount()
 		},
+		"setupDone": func() interface{} {
+			// The executors are only started after setup() has returned and
+			// its data has been processed.
+			return es.GetCurrentExecutionStatus() >= lib.ExecutionStatusRunning
+		},
+		"maxDuration": func() interface{} {
+			steps := es.Options.Scenarios.GetFullExecutionRequirements(es.ExecutionTuple)
+			maxDuration, isFinal := lib.GetEndOffset(steps)
+			if !isFinal {
+				// At least one scenario can run indefinitely.
+				return nil
+			}
+			return float64(maxDuration) / float64(time.Millisecond)
+		},
+		"segmentedVUsMax": func() interface{} {
+			return lib.GetMaxPossibleVUs(es.Options.Scenarios.GetFullExecutionRequirements(es.ExecutionTuple))
+		},
+		"globalVUsMax": func() interface{} {
+			fullTuple, err := lib.NewExecutionTuple(nil, nil)
+			if err != nil {
+				common.Throw(rt, err)
+			}
+			return lib.GetMaxPossibleVUs(es.Options.Scenarios.GetFullExecutionRequirements(fullTuple))
+		},
+		"instanceCount": func() interface{} {
+			if !knownInstances(es.Options) {
+				return nil
+			}
+			return len(es.ExecutionTuple.Sequence.ExecutionSegmentSequence)
+		},
+		"instanceIndex": func() interface{} {
+			if !knownInstances(es.Options) {
+				return nil
+			}
+			return es.ExecutionTuple.SegmentIndex
+		},
+		"segmentWeight": func() interface{} {
+			return es.ExecutionTuple.Segment.FloatLength()
+		},
+		"configHash": func() interface{} {
+			hash, err := configHash(es.Options)
+			if err != nil {
+				common.Throw(rt, err)
+			}
+			return hash
+		},
+		"scenariosStarted": func() interface{} {
+			// teardown() has no execution state, so this is only reached
+			// in setup() or in a scenario.
+			if es.GetCurrentExecutionStatus() < lib.ExecutionStatusRunning {
+				return 0
+			}
+			ss := lib.GetScenarioState(mi.GetContext())
+			if ss == nil {
+				// There is no scenario to measure the launch time from.
+				return nil
+			}
+			return startedScenarios(es.Options.Scenarios, es.ExecutionTuple, ss)
+		},
 	}
 
 	return newInfoObj(rt, ti)
@@ -186,14 +379,506 @@ func (mi *ModuleInstance) newVUInfo() (*goja.Object, error) {
 		"idInInstance":        func() interface{} { return vuState.VUID },
 		"idInTest":            func() interface{} { return vuState.VUIDGlobal },
 		"iterationInInstance": func() interface{} { return vuState.Iteration },
+		"uuid":                func() interface{} { return vuUUID(vuState.VUIDGlobal) },
+		"createdAt": func() interface{} {
+			return mi.vu.createdAt.UnixNano() / int64(time.Millisecond)
+		},
 		"iterationInScenario": func() interface{} {
 			return vuState.GetScenarioVUIter()
 		},
+		"iterationsRemainingInScenario": func() interface{} {
+			ss := lib.GetScenarioState(mi.GetContext())
+			if ss == nil {
+				return nil
+			}
+			cfg, ok := vuState.Options.Scenarios[ss.Name].(executor.PerVUIterationsConfig)
+			if !ok {
+				return nil
+			}
+			// Don't count the iteration currently running.
+			return cfg.Iterations.Int64 - int64(vuState.GetScenarioVUIter()) - 1
+		},
+		// The phase follows the status of the scenario, since k6 doesn't
+		// tell VUs when their own graceful stop begins.
+		"phase": func() interface{} {
+			ctx := mi.GetContext()
+			es, ss := lib.GetExecutionState(ctx), lib.GetScenarioState(ctx)
+			if es == nil || ss == nil {
+				return nil
+			}
+			cfg, ok := vuState.Options.Scenarios[ss.Name]
+			if ok && scenarioStatus(cfg, es.ExecutionTuple, ss.StartTime) == "gracefulStopping" {
+				return "gracefulStop"
+			}
+			return "running"
+		},
+		"scenarioExecutor": func() interface{} {
+			if ss := lib.GetScenarioState(mi.GetContext()); ss != nil {
+				return ss.Executor
+			}
+			return nil
+		},
+		// The exec function is set per scenario when the VU is activated,
+		// so the next iteration always runs the same one as the current.
+		"nextExec": func() interface{} {
+			ss := lib.GetScenarioState(mi.GetContext())
+			if ss == nil {
+				return nil
+			}
+			if cfg, ok := vuState.Options.Scenarios[ss.Name]; ok {
+				return cfg.GetExec()
+			}
+			return nil
+		},
+		"effectiveDeadline": func() interface{} {
+			deadline, ok := mi.effectiveDeadline()
+			if !ok {
+				return nil
+			}
+			return deadline.UnixNano() / int64(time.Millisecond)
+		},
+		// Return a copy, so scripts can't modify the tags the VU will use
+		// for its metrics.
+		"tags": func() interface{} { return vuState.CloneTags() },
+		"env": func() interface{} {
+			var env map[string]string
+			if err := rt.ExportTo(rt.Get("__ENV"), &env); err != nil {
+				common.Throw(rt, err)
+			}
+			// ExportTo may reuse the underlying map, so copy it to prevent
+			// scripts from modifying __ENV through it.
+			envCopy := make(map[string]string, len(env))
+			for k, v := range env {
+				envCopy[k] = v
+			}
+			return envCopy
+		},
 	}
 
 	return newInfoObj(rt, vi)
 }
 
+// knownInstances returns whether the instances of the test run are known from
+// opts: either the test isn't segmented, or the execution segment sequence is
+// configured. Otherwise k6 fills in a sequence around the execution segment of
+// the instance, e.g. 0,1/4,1/2,1 for 1/4:1/2, which doesn't match the other
+// instances.
+func knownInstances(opts lib.Options) bool {
+	return opts.ExecutionSegment == nil || opts.ExecutionSegmentSequence != nil
+}
+
+// effectiveDeadline returns the time at which the scenario the VU is running
+// in will interrupt any running iterations. It returns false outside of a
+// scenario, or if the scenario can run indefinitely.
+func (mi *ModuleInstance) effectiveDeadline() (time.Time, bool) {
+	ctx := mi.GetContext()
+	vuState, es, ss := lib.GetState(ctx), lib.GetExecutionState(ctx), lib.GetScenarioState(ctx)
+	if vuState == nil || es == nil || ss == nil {
+		return time.Time{}, false
+	}
+	cfg, ok := vuState.Options.Scenarios[ss.Name]
+	if !ok {
+		return time.Time{}, false
+	}
+	return hardStop(cfg, es.ExecutionTuple, ss.StartTime)
+}
+
+// lifecyclePhase returns the test lifecycle function the VU is currently
+// running: "init", "setup", "main", "teardown" or "summary" for
+// handleSummary(). setup(), teardown() and handleSummary() run in separate VUs
+// with ID 0, and only setup() has access to the execution state.
+func (mi *ModuleInstance) lifecyclePhase() string {
+	ctx := mi.GetContext()
+	vuState := lib.GetState(ctx)
+	switch {
+	case vuState == nil:
+		return "init"
+	case vuState.VUID != 0:
+		return "main"
+	}
+	if es := lib.GetExecutionState(ctx); es != nil && es.GetCurrentExecutionStatus() == lib.ExecutionStatusSetup {
+		return "setup"
+	}
+	if inTeardown(vuState) {
+		return "teardown"
+	}
+	return "summary"
+}
+
+// inTeardown returns whether the VU with the given state is running
+// teardown(). k6 runs teardown() in a group of its own, including any groups
+// it starts, while handleSummary() runs in the root group.
+func inTeardown(state *lib.State) bool {
+	path := lib.GroupSeparator + consts.TeardownFn
+	return state.Group != nil && (state.Group.Path == path || strings.HasPrefix(state.Group.Path, path+lib.GroupSeparator))
+}
+
+// noExecutionStateError returns the error for doing what in code that has no
+// access to the execution state: the init context, teardown() and
+// handleSummary().
+func (mi *ModuleInstance) noExecutionStateError(what string) error {
+	switch mi.lifecyclePhase() {
+	case "teardown":
+		return fmt.Errorf("%s in teardown() is not supported", what)
+	case "summary":
+		return fmt.Errorf("%s in handleSummary() is not supported", what)
+	default:
+		return fmt.Errorf("%s in the init context is not supported", what)
+	}
+}
+
+// elapsed returns the time elapsed since the test started in milliseconds, the
+// same as exec.instance.currentTestRunDuration.
+func (mi *ModuleInstance) elapsed() float64 {
+	es := lib.GetExecutionState(mi.GetContext())
+	if es == nil {
+		common.Throw(mi.GetRuntime(), mi.noExecutionStateError("getting the elapsed time"))
+	}
+	return float64(es.GetCurrentTestRunDuration()) / float64(time.Millisecond)
+}
+
+// remaining returns the time left until the end of the test, including the
+// graceful stops of the scenarios, in milliseconds. It returns nil if a
+// scenario can run indefinitely, or if the end isn't known yet because
+// setup() is still running. Like in the init context, there is no execution
+// state in teardown().
+func (mi *ModuleInstance) remaining() interface{} {
+	ctx := mi.GetContext()
+	es := lib.GetExecutionState(ctx)
+	if es == nil {
+		common.Throw(mi.GetRuntime(), mi.noExecutionStateError("getting the remaining time"))
+	}
+	ss := lib.GetScenarioState(ctx)
+	if ss == nil {
+		// The executors haven't been launched yet.
+		return nil
+	}
+	maxDuration, isFinal := lib.GetEndOffset(es.Options.Scenarios.GetFullExecutionRequirements(es.ExecutionTuple))
+	if !isFinal {
+		return nil
+	}
+	left := time.Until(launchTime(es.Options.Scenarios, ss).Add(maxDuration))
+	if left < 0 {
+		left = 0
+	}
+	return float64(left) / float64(time.Millisecond)
+}
+
+// newTestInfo returns a goja.Object with property accessors to retrieve
+// information about the test run.
+func (mi *ModuleInstance) newTestInfo() (*goja.Object, error) {
+	ctx := mi.GetContext()
+	vuState := lib.GetState(ctx)
+	if vuState == nil {
+		return nil, errors.New("getting test information in the init context is not supported")
+	}
+
+	rt := common.GetRuntime(ctx)
+	if rt == nil {
+		return nil, errors.New("goja runtime is nil in context")
+	}
+
+	ti := map[string]func() interface{}{
+		"options": func() interface{} { return optionsInfo(vuState.Options) },
+	}
+
+	return newInfoObj(rt, ti)
+}
+
+// optionsInfo returns the test options that scripts and libraries may need
+// to adapt their own behavior to the user's configuration. Options that
+// aren't set are nil, rather than the defaults k6 uses for them.
+func optionsInfo(opts lib.Options) map[string]interface{} {
+	return map[string]interface{}{
+		"noConnectionReuse":     nullBool(opts.NoConnectionReuse),
+		"noVUConnectionReuse":   nullBool(opts.NoVUConnectionReuse),
+		"batch":                 nullInt(opts.Batch),
+		"batchPerHost":          nullInt(opts.BatchPerHost),
+		"userAgent":             nullString(opts.UserAgent),
+		"maxRedirects":          nullInt(opts.MaxRedirects),
+		"discardResponseBodies": nullBool(opts.DiscardResponseBodies),
+		"vus":                   nullInt(opts.VUs),
+		"duration":              nullDurationMs(opts.Duration),
+		"iterations":            nullInt(opts.Iterations),
+		"thresholds":            thresholdsInfo(opts.Thresholds),
+		"summaryTrendStats":     summaryTrendStats(opts),
+	}
+}
+
+// summaryTrendStats returns a copy of the trend stats shown in the end of test
+// summary, or nil if they aren't configured.
+func summaryTrendStats(opts lib.Options) interface{} {
+	if opts.SummaryTrendStats == nil {
+		return nil
+	}
+	return append([]string(nil), opts.SummaryTrendStats...)
+}
+
+// thresholdsInfo returns the configured thresholds of every metric, with the
+// same fields as their object form in the script options.
+func thresholdsInfo(thresholds map[string]stats.Thresholds) map[string]interface{} {
+	info := make(map[string]interface{}, len(thresholds))
+	for name, ths := range thresholds {
+		list := make([]interface{}, 0, len(ths.Thresholds))
+		for _, th := range ths.Thresholds {
+			list = append(list, map[string]interface{}{
+				"threshold":      th.Source,
+				"abortOnFail":    th.AbortOnFail,
+				"delayAbortEval": nullDurationMs(th.AbortGracePeriod),
+			})
+		}
+		info[name] = list
+	}
+	return info
+}
+
+// nullBool returns the value of v, or nil if it's not set.
+func nullBool(v null.Bool) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return v.Bool
+}
+
+// nullString returns the value of v, or nil if it's not set.
+func nullString(v null.String) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return v.String
+}
+
+// nullInt returns the value of v, or nil if it's not set.
+func nullInt(v null.Int) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return v.Int64
+}
+
+// nullDurationMs returns the value of d in milliseconds, or nil if it's not
+// set.
+func nullDurationMs(d types.NullDuration) interface{} {
+	if !d.Valid {
+		return nil
+	}
+	return float64(d.Duration) / float64(time.Millisecond)
+}
+
+// publish stores msg as the latest message for topic, making it available to
+// all VUs on this instance.
+func (mi *ModuleInstance) publish(topic string, msg goja.Value) {
+	rt := mi.GetRuntime()
+	if mi.GetState() == nil {
+		common.Throw(rt, errors.New("publishing messages in the init context is not supported"))
+	}
+	data, err := json.Marshal(msg.Export())
+	if err != nil {
+		common.Throw(rt, fmt.Errorf("error marshaling message for topic '%s' to JSON: %w", topic, err))
+	}
+	mi.root.bus.publish(topic, data)
+}
+
+// subscribe returns a copy of the latest message published to topic, or
+// undefined if nothing has been published to it yet.
+func (mi *ModuleInstance) subscribe(topic string) goja.Value {
+	rt := mi.GetRuntime()
+	if mi.GetState() == nil {
+		common.Throw(rt, errors.New("subscribing to messages in the init context is not supported"))
+	}
+	data, ok := mi.root.bus.latest(topic)
+	if !ok {
+		return goja.Undefined()
+	}
+	var msg interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		common.Throw(rt, fmt.Errorf("error unmarshaling message for topic '%s' from JSON: %w", topic, err))
+	}
+	return rt.ToValue(msg)
+}
+
+// claimSequence returns the next number of the named instance-wide sequence.
+func (mi *ModuleInstance) claimSequence(name string) int64 {
+	if mi.GetState() == nil {
+		common.Throw(mi.GetRuntime(), errors.New("claiming sequence numbers in the init context is not supported"))
+	}
+	return mi.root.sequences.claim(name)
+}
+
+// rateLimit blocks until the named instance-wide rate limiter allows another
+// operation, or the VU context is done.
+func (mi *ModuleInstance) rateLimit(name string, opsPerSec float64) {
+	rt := mi.GetRuntime()
+	if mi.GetState() == nil {
+		common.Throw(rt, errors.New("rate limiting in the init context is not supported"))
+	}
+	if !(opsPerSec > 0) || math.IsInf(opsPerSec, 1) {
+		common.Throw(rt, fmt.Errorf("invalid rate for limiter '%s': %v, it must be positive and finite", name, opsPerSec))
+	}
+	lim, err := mi.root.limiters.get(name, opsPerSec)
+	if err != nil {
+		common.Throw(rt, err)
+	}
+	if err := lim.Wait(mi.GetContext()); err != nil {
+		common.Throw(rt, err)
+	}
+}
+
+// barrier blocks until the given number of VUs have called it with the same
+// name, the optional timeout in milliseconds expires, or the VU context is
+// done.
+func (mi *ModuleInstance) barrier(name string, parties int64, timeoutMs float64) {
+	rt := mi.GetRuntime()
+	if mi.GetState() == nil {
+		common.Throw(rt, errors.New("waiting on a barrier in the init context is not supported"))
+	}
+	if parties <= 0 {
+		common.Throw(rt, fmt.Errorf("invalid parties for barrier '%s': %d, it must be positive", name, parties))
+	}
+	if timeoutMs < 0 {
+		common.Throw(rt, fmt.Errorf("invalid timeout for barrier '%s': %v, it must not be negative", name, timeoutMs))
+	}
+	timeout := time.Duration(timeoutMs * float64(time.Millisecond))
+	if err := mi.root.barriers.wait(mi.GetContext(), name, parties, timeout); err != nil {
+		common.Throw(rt, err)
+	}
+}
+
+// withTags calls fn with the given tags added to the VU tags, so they are
+// applied to all metrics emitted by fn, and restores the previous VU tags
+// once fn returns or throws.
+func (mi *ModuleInstance) withTags(tags map[string]string, fn goja.Callable) goja.Value {
+	rt := mi.GetRuntime()
+	state := mi.GetState()
+	if state == nil {
+		common.Throw(rt, errors.New("applying tags in the init context is not supported"))
+	}
+	if fn == nil {
+		common.Throw(rt, errors.New("withTags() requires a function as its second argument"))
+	}
+
+	oldTags := state.Tags
+	newTags := state.CloneTags()
+	for k, v := range tags {
+		newTags[k] = v
+	}
+	state.Tags = newTags
+	defer func() { state.Tags = oldTags }()
+
+	ret, err := fn(goja.Undefined())
+	if err != nil {
+		rethrow(rt, err)
+	}
+	return ret
+}
+
+// concurrency calls fn while holding one of the limit slots of the named
+// instance-wide semaphore, blocking until a slot is free or the VU context is
+// done. The slot is released once fn returns or throws.
+func (mi *ModuleInstance) concurrency(name string, limit int64, fn goja.Callable) goja.Value {
+	rt := mi.GetRuntime()
+	if mi.GetState() == nil {
+		common.Throw(rt, errors.New("limiting concurrency in the init context is not supported"))
+	}
+	if limit <= 0 {
+		common.Throw(rt, fmt.Errorf("invalid limit for semaphore '%s': %d, it must be positive", name, limit))
+	}
+	if fn == nil {
+		common.Throw(rt, errors.New("concurrency() requires a function as its third argument"))
+	}
+
+	release, err := mi.root.semaphores.acquire(mi.GetContext(), name, limit)
+	if err != nil {
+		common.Throw(rt, err)
+	}
+	defer release()
+
+	ret, err := fn(goja.Undefined())
+	if err != nil {
+		rethrow(rt, err)
+	}
+	return ret
+}
+
+// onceScenario calls fn with the name of the current scenario if no other VU
+// on the instance has called it for that scenario yet. Otherwise it blocks
+// until the first call of fn for the scenario has returned, or the VU context
+// is done, and throws an error if that call threw.
+func (mi *ModuleInstance) onceScenario(fn goja.Callable) {
+	rt := mi.GetRuntime()
+	ctx := mi.GetContext()
+	ss := lib.GetScenarioState(ctx)
+	if ss == nil {
+		common.Throw(rt, errors.New("onceScenario() can only be called in a scenario"))
+	}
+	if fn == nil {
+		common.Throw(rt, errors.New("onceScenario() requires a function as its argument"))
+	}
+
+	var fnErr error
+	err := mi.root.onces.do(ctx, ss.Name, func() error {
+		_, fnErr = fn(goja.Undefined(), rt.ToValue(ss.Name))
+		if fnErr != nil {
+			// The exception belongs to this VU's runtime, so the other VUs
+			// only get its message.
+			return fmt.Errorf("onceScenario() failed for scenario '%s': %s", ss.Name, fnErr.Error())
+		}
+		return nil
+	})
+	if fnErr != nil {
+		rethrow(rt, fnErr)
+	}
+	if err != nil {
+		common.Throw(rt, err)
+	}
+}
+
+// rethrow throws err returned from calling a JS function. Exceptions thrown
+// by the function are rethrown as is, so scripts can catch the original
+// value.
+func rethrow(rt *goja.Runtime, err error) {
+	var ex *goja.Exception
+	if errors.As(err, &ex) {
+		panic(ex)
+	}
+	common.Throw(rt, err)
+}
+
+// configHash returns the hex-encoded SHA-256 hash of the JSON encoding of
+// opts, without the execution segment of the instance, so it's the same for
+// all instances of a test run. Map keys are sorted when encoding, so the hash
+// doesn't depend on the order the options were defined in.
+func configHash(opts lib.Options) (string, error) {
+	opts.ExecutionSegment = nil
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling options to JSON: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// vuUUID returns the version 5 UUID of the VU with the given global ID, which
+// is the same for the VU in every test run.
+func vuUUID(idInTest uint64) string {
+	u := vuUUIDBytes(idInTest)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// vuUUIDBytes returns the bytes of the version 5 UUID of the VU with the given
+// global ID.
+func vuUUIDBytes(idInTest uint64) []byte {
+	name := make([]byte, 8)
+	binary.BigEndian.PutUint64(name, idInTest)
+	h := sha1.New()
+	h.Write(vuUUIDNamespace[:])
+	h.Write(name)
+	u := h.Sum(nil)[:16]
+	u[6] = (u[6] & 0x0f) | 0x50 // version 5
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return u
+}
+
 func newInfoObj(rt *goja.Runtime, props map[string]func() interface{}) (*goja.Object, error) {
 	o := rt.NewObject()
 
@@ -3,21 +3,29 @@ package execution
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/guregu/null.v3"
 
 	"go.k6.io/k6/core/local"
 	"go.k6.io/k6/js"
 	"go.k6.io/k6/js/modules"
 	"go.k6.io/k6/lib"
+	"go.k6.io/k6/lib/executor"
 	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/lib/types"
 	"go.k6.io/k6/loader"
 	"go.k6.io/k6/stats"
 )
@@ -58,13 +66,19 @@ func TestExecutionInfoVUSharing(t *testing.T) {
 		};
 
 		export function cvus() {
-			const info = Object.assign({scenario: 'cvus'}, exec.vu);
+			const info = Object.assign({
+				scenario: 'cvus',
+				scenarioIterationInInstance: exec.scenario.iterationInInstance,
+			}, exec.vu);
 			console.log(JSON.stringify(info));
 			sleep(0.2);
 		};
 
 		export function carr() {
-			const info = Object.assign({scenario: 'carr'}, exec.vu);
+			const info = Object.assign({
+				scenario: 'carr',
+				scenarioIterationInInstance: exec.scenario.iterationInInstance,
+			}, exec.vu);
 			console.log(JSON.stringify(info));
 		};
 `)
@@ -93,12 +107,14 @@ func TestExecutionInfoVUSharing(t *testing.T) {
 		scIter    map[string]uint64
 	}
 	vuStats := map[uint64]*vuStat{}
+	scIters := map[string][]uint64{}
 
 	type logEntry struct {
-		IdInInstance        uint64
-		Scenario            string
-		IterationInInstance uint64
-		IterationInScenario uint64
+		IdInInstance                uint64
+		Scenario                    string
+		IterationInInstance         uint64
+		IterationInScenario         uint64
+		ScenarioIterationInInstance uint64
 	}
 
 	errCh := make(chan error, 1)
@@ -123,6 +139,7 @@ func TestExecutionInfoVUSharing(t *testing.T) {
 			if le.IterationInScenario > vuStats[le.IdInInstance].scIter[le.Scenario] {
 				vuStats[le.IdInInstance].scIter[le.Scenario] = le.IterationInScenario
 			}
+			scIters[le.Scenario] = append(scIters[le.Scenario], le.ScenarioIterationInInstance)
 		}
 		require.Len(t, vuStats, 2)
 		// Both VUs should complete 10 iterations each globally, but 5
@@ -132,6 +149,12 @@ func TestExecutionInfoVUSharing(t *testing.T) {
 			assert.Equal(t, uint64(4), v.scIter["cvus"])
 			assert.Equal(t, uint64(4), v.scIter["carr"])
 		}
+		// While the VU scenario iterations repeat across the two VUs, the
+		// scenario iterations are unique across all VUs.
+		expScIters := []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		require.Len(t, scIters, 2)
+		assert.ElementsMatch(t, expScIters, scIters["cvus"])
+		assert.ElementsMatch(t, expScIters, scIters["carr"])
 	case <-time.After(10 * time.Second):
 		t.Fatal("timed out")
 	}
@@ -305,101 +328,2255 @@ func TestSharedIterationsStable(t *testing.T) {
 	}
 }
 
+// Ensure that the remaining scenario iterations count down to 0 over the
+// iterations of the scenario, as of the start of each of them.
+func TestScenarioIterationsRemaining(t *testing.T) {
+	t.Parallel()
+	script := []byte(`
+		import exec from 'k6/x/execution';
+		import { sleep } from 'k6';
+
+		export let options = {
+			scenarios: {
+				test: {
+					executor: 'shared-iterations',
+					vus: 3,
+					iterations: 9,
+				},
+			},
+		};
+		export default function () {
+			console.log(exec.scenario.iterationsRemaining);
+			sleep(0.05);
+		}
+`)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.InfoLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		var remaining []string
+		for _, entry := range logHook.Drain() {
+			remaining = append(remaining, entry.Message)
+		}
+		assert.ElementsMatch(t, []string{"8", "7", "6", "5", "4", "3", "2", "1", "0"}, remaining)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+// Ensure that the test-wide scenario iteration is stable during the
+// execution of an iteration, and unique per scenario, when VUs are shared
+// between scenarios.
+func TestScenarioIterationStableVUSharing(t *testing.T) {
+	t.Parallel()
+	script := []byte(`
+		import exec from 'k6/x/execution';
+		import { sleep } from 'k6';
+
+		// The cvus scenario should reuse the two VUs created for the carr scenario.
+		export let options = {
+			scenarios: {
+				carr: {
+					executor: 'constant-arrival-rate',
+					exec: 'run',
+					rate: 9,
+					timeUnit: '0.95s',
+					duration: '1s',
+					preAllocatedVUs: 2,
+					maxVUs: 10,
+					gracefulStop: '100ms',
+				},
+				cvus: {
+					executor: 'constant-vus',
+					exec: 'run',
+					vus: 2,
+					duration: '1s',
+					startTime: '2s',
+					gracefulStop: '0s',
+				},
+			},
+		};
+
+		export function run() {
+			const before = exec.scenario.iterationInTest;
+			sleep(0.1);
+			console.log(JSON.stringify({
+				scenario: exec.scenario.name,
+				before: before,
+				after: exec.scenario.iterationInTest,
+			}));
+		};
+`)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.InfoLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	type logEntry struct {
+		Scenario      string
+		Before, After int64
+	}
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		entries := logHook.Drain()
+		require.NotEmpty(t, entries)
+		scIters := map[string][]int64{}
+		le := &logEntry{}
+		for _, entry := range entries {
+			err = json.Unmarshal([]byte(entry.Message), le)
+			require.NoError(t, err)
+			require.Equal(t, le.Before, le.After)
+			scIters[le.Scenario] = append(scIters[le.Scenario], le.After)
+		}
+		require.Len(t, scIters, 2)
+		for sc, iters := range scIters {
+			exp := make([]int64, len(iters))
+			for i := range exp {
+				exp[i] = int64(i)
+			}
+			assert.ElementsMatch(t, exp, iters, sc)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestLifecyclePhase(t *testing.T) {
+	t.Parallel()
+	script := []byte(`
+		import exec from 'k6/x/execution';
+		import { group } from 'k6';
+
+		export let options = {
+			scenarios: {
+				test: {
+					executor: 'per-vu-iterations',
+					vus: 1,
+					iterations: 1,
+				},
+			},
+		};
+
+		console.log(exec.lifecyclePhase());
+
+		export function setup() {
+			console.log(exec.lifecyclePhase());
+		}
+		export default function () {
+			console.log(exec.lifecyclePhase());
+		}
+		export function teardown() {
+			console.log(exec.lifecyclePhase());
+			group('nested', function() {
+				console.log(exec.lifecyclePhase());
+			});
+		}
+		export function handleSummary() {
+			console.log(exec.lifecyclePhase());
+			return {};
+		}
+`)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.InfoLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{
+		SetupTimeout:    types.NullDurationFrom(5 * time.Second),
+		TeardownTimeout: types.NullDurationFrom(5 * time.Second),
+	})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		_, err = runner.HandleSummary(ctx, &lib.Summary{
+			Metrics:   map[string]*stats.Metric{},
+			RootGroup: runner.GetDefaultGroup(),
+		})
+		require.NoError(t, err)
+		var phases []string
+		for _, entry := range logHook.Drain() {
+			if entry.Message != "init" {
+				phases = append(phases, entry.Message)
+			}
+		}
+		assert.Equal(t, []string{"setup", "main", "teardown", "teardown", "summary"}, phases)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestInstanceInfoSetupTeardown(t *testing.T) {
+	t.Parallel()
+	script := []byte(`
+		import exec from 'k6/x/execution';
+
+		export let options = {
+			scenarios: {
+				test: {
+					executor: 'per-vu-iterations',
+					vus: 1,
+					iterations: 1,
+				},
+			},
+		};
+
+		export function setup() {
+			console.log('setup scenariosStarted ' + exec.instance.scenariosStarted);
+			console.log('setup remaining ' + exec.time.remaining());
+		}
+		export default function () {
+			console.log('main scenariosStarted ' + exec.instance.scenariosStarted);
+		}
+		export function teardown() {
+			try {
+				console.log('teardown scenariosStarted ' + exec.instance.scenariosStarted);
+			} catch (e) {
+				console.log('teardown instance error: ' + e);
+			}
+			try {
+				console.log('teardown remaining ' + exec.time.remaining());
+			} catch (e) {
+				console.log('teardown remaining error: ' + e);
+			}
+			try {
+				console.log('teardown elapsed ' + exec.time.elapsed());
+			} catch (e) {
+				console.log('teardown elapsed error: ' + e);
+			}
+		}
+`)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.InfoLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{
+		SetupTimeout:    types.NullDurationFrom(5 * time.Second),
+		TeardownTimeout: types.NullDurationFrom(5 * time.Second),
+	})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		var messages []string
+		for _, entry := range logHook.Drain() {
+			messages = append(messages, entry.Message)
+		}
+		assert.Equal(t, []string{
+			"setup scenariosStarted 0",
+			"setup remaining null",
+			"main scenariosStarted 1",
+			"teardown instance error: getting instance information in the init context is not supported",
+			"teardown remaining error: getting the remaining time in teardown() is not supported",
+			"teardown elapsed error: getting the elapsed time in teardown() is not supported",
+		}, messages)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestOnceScenario(t *testing.T) {
+	t.Parallel()
+	script := []byte(fmt.Sprintf(`
+		import exec from '%s';
+		import { sleep } from 'k6';
+
+		// The once_b scenario should reuse the VUs created for once_a.
+		export let options = {
+			scenarios: {
+				once_a: {
+					executor: 'per-vu-iterations',
+					vus: 3,
+					iterations: 2,
+				},
+				once_b: {
+					executor: 'per-vu-iterations',
+					vus: 3,
+					iterations: 2,
+					startTime: '500ms',
+				},
+			},
+		};
+
+		export default function () {
+			exec.onceScenario(function(name) {
+				console.log('once ' + name);
+				sleep(0.2);
+				exec.publish('test_once_scenario_' + name, true);
+			});
+			var name = exec.scenario.name;
+			if (exec.subscribe('test_once_scenario_' + name) !== true) {
+				throw new Error('onceScenario() returned before the function was done');
+			}
+			console.log('iteration ' + name);
+		}
+`, registerModule(t)))
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.InfoLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		counts := map[string]int{}
+		for _, entry := range logHook.Drain() {
+			counts[entry.Message]++
+		}
+		assert.Equal(t, map[string]int{
+			"once once_a":      1,
+			"once once_b":      1,
+			"iteration once_a": 6,
+			"iteration once_b": 6,
+		}, counts)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+// Ensure that the instance-wide and test-wide scenario iterations diverge
+// when the test is segmented, since each instance runs only its share of the
+// scenario iterations.
+func TestSharedIterationsSegmented(t *testing.T) {
+	t.Parallel()
+	script := []byte(`
+		import exec from 'k6/x/execution';
+
+		export let options = {
+			scenarios: {
+				test: {
+					executor: 'shared-iterations',
+					vus: 4,
+					iterations: 20,
+				},
+			},
+		};
+		export default function () {
+			console.log(JSON.stringify(exec.scenario));
+		}
+`)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.InfoLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	seg, err := lib.NewExecutionSegmentFromString("1/4:1/2")
+	require.NoError(t, err)
+	seq, err := lib.NewExecutionSegmentSequenceFromString("0,1/4,1/2,3/4,1")
+	require.NoError(t, err)
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{
+		ExecutionSegment:         seg,
+		ExecutionSegmentSequence: &seq,
+	})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	gotLocalIters, gotGlobalIters := []int64{}, []int64{}
+
+	type logEntry struct{ IterationInInstance, IterationInTest int64 }
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		entries := logHook.Drain()
+		le := &logEntry{}
+		for _, entry := range entries {
+			err = json.Unmarshal([]byte(entry.Message), le)
+			require.NoError(t, err)
+			// This instance runs every 4th scenario iteration, starting from
+			// the second one.
+			assert.Equal(t, 4*le.IterationInInstance+1, le.IterationInTest)
+			gotLocalIters = append(gotLocalIters, le.IterationInInstance)
+			gotGlobalIters = append(gotGlobalIters, le.IterationInTest)
+		}
+
+		assert.ElementsMatch(t, []int64{0, 1, 2, 3, 4}, gotLocalIters)
+		assert.ElementsMatch(t, []int64{1, 5, 9, 13, 17}, gotGlobalIters)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
 func TestExecutionInfo(t *testing.T) {
 	t.Parallel()
 
-	testCases := []struct {
-		name, script, expErr string
-	}{
-		{name: "vu_ok", script: `
+	testCases := []struct {
+		name, script, expErr string
+	}{
+		{name: "vu_ok", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			if (exec.instance.segmentWeight !== 1) throw new Error('unexpected segmentWeight: '+exec.instance.segmentWeight);
+			if (exec.vu.idInInstance !== 1) throw new Error('unexpected VU ID: '+exec.vu.idInInstance);
+			if (exec.vu.idInTest !== 10) throw new Error('unexpected global VU ID: '+exec.vu.idInTest);
+			if (exec.vu.iterationInInstance !== 0) throw new Error('unexpected VU iteration: '+exec.vu.iterationInInstance);
+			if (exec.vu.iterationInScenario !== 0) throw new Error('unexpected scenario iteration: '+exec.vu.iterationInScenario);
+			if (exec.vu.effectiveDeadline !== null) throw new Error('unexpected effectiveDeadline: '+exec.vu.effectiveDeadline);
+			if (exec.vu.scenarioExecutor !== exec.scenario.executor) throw new Error('unexpected scenario executor: '+exec.vu.scenarioExecutor);
+			if (exec.vu.nextExec !== null) throw new Error('unexpected nextExec: '+exec.vu.nextExec);
+			if (exec.vu.phase !== 'running') throw new Error('unexpected phase: '+exec.vu.phase);
+			if (exec.vu.iterationsRemainingInScenario !== null) throw new Error('unexpected iterationsRemainingInScenario: '+exec.vu.iterationsRemainingInScenario);
+			if (exec.vu.uuid !== '781c7c75-564d-59a6-9846-64034300b7c6') throw new Error('unexpected uuid: '+exec.vu.uuid);
+			var createdAt = exec.vu.createdAt;
+			if (!(createdAt > 0 && createdAt <= Date.now())) throw new Error('unexpected createdAt: '+createdAt);
+			if (exec.vu.createdAt !== createdAt) throw new Error('createdAt changed: '+exec.vu.createdAt);
+		}`},
+		{name: "vu_nested_ok", script: `
+		var exec = require('k6/x/execution');
+
+		// There are no modules in this k6 version that spawn sub-contexts, so
+		// code called back from other modules is the closest thing: it runs on
+		// the VU's runtime, so it resolves the owning VU.
+		function checkVU(where) {
+			if (exec.vu.idInTest !== 10) throw new Error('unexpected global VU ID in '+where+': '+exec.vu.idInTest);
+			if (exec.vu.iterationInInstance !== 0) throw new Error('unexpected VU iteration in '+where+': '+exec.vu.iterationInInstance);
+		}
+
+		exports.default = function() {
+			var vu = exec.vu;
+			exec.withTags({ nested: 'true' }, function() {
+				checkVU('withTags()');
+				exec.retry(function() {
+					checkVU('retry()');
+					if (vu.idInInstance !== 1) throw new Error('unexpected VU ID: '+vu.idInInstance);
+				});
+			});
+			[1, 2].forEach(function() { checkVU('forEach()'); });
+		}`},
+		{name: "vu_next_exec", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'per-vu-iterations' },
+			},
+		};
+
+		exports.default = function() {
+			if (exec.vu.nextExec !== 'default') throw new Error('unexpected nextExec: '+exec.vu.nextExec);
+		}`},
+		{name: "vu_tags", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = { tags: { testid: 'vu_tags' } };
+
+		exports.default = function() {
+			var tags = exec.vu.tags;
+			if (tags.testid !== 'vu_tags') throw new Error('unexpected testid tag: '+tags.testid);
+			tags.testid = 'changed';
+			if (exec.vu.tags.testid !== 'vu_tags') throw new Error('VU tags were modified: '+exec.vu.tags.testid);
+		}`},
+		{name: "vu_env", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var env = exec.vu.env;
+			if (env.TEST_VAR !== 'value') throw new Error('unexpected TEST_VAR: '+env.TEST_VAR);
+			if (Object.keys(env).length !== Object.keys(__ENV).length) throw new Error('unexpected env: '+JSON.stringify(env));
+			env.TEST_VAR = 'changed';
+			if (__ENV.TEST_VAR !== 'value') throw new Error('__ENV was modified: '+__ENV.TEST_VAR);
+		}`},
+		{name: "vu_deadline", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 1, duration: '1s', gracefulStop: '500ms' },
+			},
+		};
+
+		exports.default = function() {
+			var deadline = exec.vu.effectiveDeadline;
+			var exp = exec.scenario.startTime + 1500;
+			if (deadline !== exp) throw new Error('unexpected effectiveDeadline: '+deadline+' != '+exp);
+		}`},
+		{name: "vu_err", script: `
+		var exec = require('k6/x/execution');
+		exec.vu;
+		`, expErr: "getting VU information in the init context is not supported"},
+		{name: "scenario_ok", script: `
+		var exec = require('k6/x/execution');
+		var sleep = require('k6').sleep;
+
+		exports.default = function() {
+			var si = exec.scenario;
+			sleep(0.1);
+			if (si.name !== 'default') throw new Error('unexpected scenario name: '+si.name);
+			if (si.executor !== 'test-exec') throw new Error('unexpected executor: '+si.executor);
+			if (si.startTime > new Date().getTime()) throw new Error('unexpected startTime: '+si.startTime);
+			if (si.vusMax !== null) throw new Error('unexpected vusMax: '+si.vusMax);
+			if (si.relativeWeight !== null) throw new Error('unexpected relativeWeight: '+si.relativeWeight);
+			if (si.startOffset !== 0) throw new Error('unexpected startOffset: '+si.startOffset);
+			if (si.index !== null) throw new Error('unexpected index: '+si.index);
+			if (si.status !== 'running') throw new Error('unexpected status: '+si.status);
+			if (si.gracefulRampDown !== null) throw new Error('unexpected gracefulRampDown: '+si.gracefulRampDown);
+			if (si.progress !== 0.1) throw new Error('unexpected progress: '+si.progress);
+			if (si.iterationInInstance !== 3) throw new Error('unexpected scenario local iteration: '+si.iterationInInstance);
+			if (si.iterationsRemaining !== null) throw new Error('unexpected iterationsRemaining: '+si.iterationsRemaining);
+			if (si.iterationInTest !== 4) throw new Error('unexpected scenario local iteration: '+si.iterationInTest);
+		}`},
+		{name: "scenario_iterations_remaining", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'per-vu-iterations', vus: 2, iterations: 5 },
+			},
+		};
+
+		exports.default = function() {
+			var remaining = exec.scenario.iterationsRemaining;
+			if (remaining !== 6) throw new Error('unexpected iterationsRemaining: '+remaining);
+		}`},
+		{name: "scenario_offset", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'per-vu-iterations', startTime: '1.5s' },
+			},
+		};
+
+		exports.default = function() {
+			var offset = exec.scenario.startOffset;
+			if (offset !== 1500) throw new Error('unexpected startOffset: '+offset);
+		}`},
+		{name: "scenario_index", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				later: { executor: 'per-vu-iterations', startTime: '1s' },
+				default: { executor: 'per-vu-iterations', startTime: '500ms' },
+				another: { executor: 'per-vu-iterations', startTime: '500ms' },
+				first: { executor: 'per-vu-iterations' },
+			},
+		};
+
+		exports.default = function() {
+			var index = exec.scenario.index;
+			if (index !== 2) throw new Error('unexpected index: '+index);
+		}`},
+		{name: "scenario_status", script: `
+		var exec = require('k6/x/execution');
+		var sleep = require('k6').sleep;
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 1, duration: '200ms', gracefulStop: '10s' },
+			},
+		};
+
+		exports.default = function() {
+			var status = exec.scenario.status;
+			if (status !== 'running') throw new Error('unexpected status: '+status);
+			if (exec.vu.phase !== 'running') throw new Error('unexpected phase: '+exec.vu.phase);
+			sleep(0.3);
+			status = exec.scenario.status;
+			if (status !== 'gracefulStopping') throw new Error('unexpected status: '+status);
+			if (exec.vu.phase !== 'gracefulStop') throw new Error('unexpected phase: '+exec.vu.phase);
+		}`},
+		{name: "scenario_ramp_down", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: {
+					executor: 'ramping-vus',
+					stages: [{ duration: '1s', target: 2 }],
+					gracefulRampDown: '5s',
+				},
+			},
+		};
+
+		exports.default = function() {
+			var rampDown = exec.scenario.gracefulRampDown;
+			if (rampDown !== 5000) throw new Error('unexpected gracefulRampDown: '+rampDown);
+		}`},
+		{name: "scenario_weight", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 3, duration: '1s' },
+				other: { executor: 'constant-arrival-rate', rate: 1, duration: '1s', preAllocatedVUs: 1, maxVUs: 1 },
+			},
+		};
+
+		exports.default = function() {
+			var vusMax = exec.scenario.vusMax;
+			if (vusMax !== 3) throw new Error('unexpected vusMax: '+vusMax);
+			var weight = exec.scenario.relativeWeight;
+			if (weight !== 0.75) throw new Error('unexpected relativeWeight: '+weight);
+		}`},
+		{name: "scenario_target_vus", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: {
+					executor: 'ramping-vus',
+					stages: [{ duration: '0s', target: 5 }, { duration: '1h', target: 5 }],
+				},
+			},
+		};
+
+		exports.default = function() {
+			var si = exec.scenario;
+			if (si.currentTarget !== 5) throw new Error('unexpected currentTarget: '+si.currentTarget);
+			if (si.currentTargetUnit !== 'vus') throw new Error('unexpected currentTargetUnit: '+si.currentTargetUnit);
+		}`},
+		{name: "scenario_target_rps", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-arrival-rate', rate: 30, timeUnit: '1m', duration: '1m', preAllocatedVUs: 1, maxVUs: 1 },
+			},
+		};
+
+		exports.default = function() {
+			var si = exec.scenario;
+			if (si.vusMax !== 1) throw new Error('unexpected vusMax: '+si.vusMax);
+			if (si.currentTarget !== 0.5) throw new Error('unexpected currentTarget: '+si.currentTarget);
+			if (si.currentTargetUnit !== 'rps') throw new Error('unexpected currentTargetUnit: '+si.currentTargetUnit);
+		}`},
+		{name: "scenario_tags", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			tags: { testid: 'tags', env: 'staging' },
+			systemTags: ['scenario'],
+			scenarios: {
+				default: { executor: 'per-vu-iterations', tags: { env: 'prod' } },
+			},
+		};
+
+		exports.default = function() {
+			var tags = exec.scenario.effectiveTags;
+			var exp = JSON.stringify({ env: 'prod', scenario: 'default', testid: 'tags' });
+			var got = JSON.stringify(tags, Object.keys(tags).sort());
+			if (got !== exp) throw new Error('unexpected effectiveTags: '+got);
+			tags.env = 'changed';
+			if (exec.scenario.effectiveTags.env !== 'prod') throw new Error('effectiveTags were modified');
+		}`},
+		{name: "scenario_err", script: `
+		var exec = require('k6/x/execution');
+		exec.scenario;
+		`, expErr: "getting scenario information in the init context is not supported"},
+		{name: "test_ok", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var ti = exec.instance;
+			if (ti.currentTestRunDuration !== 0) throw new Error('unexpected test duration: '+ti.currentTestRunDuration);
+			if (ti.vusActive !== 1) throw new Error('unexpected vusActive: '+ti.vusActive);
+			if (ti.vusInitialized !== 0) throw new Error('unexpected vusInitialized: '+ti.vusInitialized);
+			if (ti.iterationsCompleted !== 0) throw new Error('unexpected iterationsCompleted: '+ti.iterationsCompleted);
+			if (ti.iterationsInterrupted !== 0) throw new Error('unexpected iterationsInterrupted: '+ti.iterationsInterrupted);
+			if (ti.segmentedVUsMax !== ti.globalVUsMax) throw new Error('unexpected VUs max: '+ti.segmentedVUsMax+' != '+ti.globalVUsMax);
+			if (ti.setupDone !== true) throw new Error('unexpected setupDone: '+ti.setupDone);
+			if (ti.instanceCount !== 1) throw new Error('unexpected instanceCount: '+ti.instanceCount);
+			if (ti.instanceIndex !== 0) throw new Error('unexpected instanceIndex: '+ti.instanceIndex);
+		}`},
+		{name: "test_max_duration", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 1, duration: '1s', startTime: '2s', gracefulStop: '500ms' },
+				other: { executor: 'per-vu-iterations', maxDuration: '1s', gracefulStop: '0s' },
+			},
+		};
+
+		exports.default = function() {
+			var maxDuration = exec.instance.maxDuration;
+			if (maxDuration !== 3500) throw new Error('unexpected maxDuration: '+maxDuration);
+		}`},
+		{name: "test_max_duration_open", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'externally-controlled', vus: 1, maxVUs: 1, duration: '0s' },
+			},
+		};
+
+		exports.default = function() {
+			var maxDuration = exec.instance.maxDuration;
+			if (maxDuration !== null) throw new Error('unexpected maxDuration: '+maxDuration);
+		}`},
+		{name: "test_segment", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			executionSegment: '1/4:1/2',
+			executionSegmentSequence: '0,1/4,1/2,3/4,1',
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 8, duration: '1s' },
+			},
+		};
+
+		exports.default = function() {
+			var ti = exec.instance;
+			if (ti.segmentedVUsMax !== 2) throw new Error('unexpected segmentedVUsMax: '+ti.segmentedVUsMax);
+			if (ti.globalVUsMax !== 8) throw new Error('unexpected globalVUsMax: '+ti.globalVUsMax);
+			if (ti.instanceCount !== 4) throw new Error('unexpected instanceCount: '+ti.instanceCount);
+			if (ti.instanceIndex !== 1) throw new Error('unexpected instanceIndex: '+ti.instanceIndex);
+			if (ti.segmentWeight !== 0.25) throw new Error('unexpected segmentWeight: '+ti.segmentWeight);
+			if (!/^[0-9a-f]{64}$/.test(ti.configHash)) throw new Error('unexpected configHash: '+ti.configHash);
+		}`},
+		{name: "test_segment_without_sequence", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			executionSegment: '1/4:1/2',
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 8, duration: '1s' },
+			},
+		};
+
+		exports.default = function() {
+			var ti = exec.instance;
+			if (ti.instanceCount !== null) throw new Error('unexpected instanceCount: '+ti.instanceCount);
+			if (ti.instanceIndex !== null) throw new Error('unexpected instanceIndex: '+ti.instanceIndex);
+			if (ti.segmentWeight !== 0.25) throw new Error('unexpected segmentWeight: '+ti.segmentWeight);
+		}`},
+		{name: "test_scenarios_started", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 1, duration: '1s' },
+				later: { executor: 'constant-vus', vus: 1, duration: '1s', startTime: '1h' },
+				idle: { executor: 'constant-vus', vus: 0, duration: '1s' },
+			},
+		};
+
+		exports.default = function() {
+			var started = exec.instance.scenariosStarted;
+			if (started !== 1) throw new Error('unexpected scenariosStarted: '+started);
+		}`},
+		{name: "time_ok", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 1, duration: '10s', gracefulStop: '5s' },
+			},
+		};
+
+		exports.default = function() {
+			var elapsed = exec.time.elapsed();
+			if (elapsed !== exec.instance.currentTestRunDuration) throw new Error('unexpected elapsed: '+elapsed);
+			var remaining = exec.time.remaining();
+			if (!(remaining > 14000 && remaining <= 15000)) throw new Error('unexpected remaining: '+remaining);
+		}`},
+		{name: "time_open", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'externally-controlled', vus: 1, maxVUs: 1, duration: '0' },
+			},
+		};
+
+		exports.default = function() {
+			var remaining = exec.time.remaining();
+			if (remaining !== null) throw new Error('unexpected remaining: '+remaining);
+		}`},
+		{name: "time_err", script: `
+		var exec = require('k6/x/execution');
+		exec.time.elapsed();
+		`, expErr: "getting the elapsed time in the init context is not supported"},
+		{name: "test_options", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			noConnectionReuse: true,
+			batch: 15,
+			batchPerHost: 5,
+			userAgent: 'test-agent/1.0',
+			maxRedirects: 3,
+			discardResponseBodies: true,
+		};
+
+		exports.default = function() {
+			var opts = exec.test.options;
+			if (opts.batch !== 15) throw new Error('unexpected batch: '+opts.batch);
+			if (opts.batchPerHost !== 5) throw new Error('unexpected batchPerHost: '+opts.batchPerHost);
+			if (opts.noConnectionReuse !== true) throw new Error('unexpected noConnectionReuse: '+opts.noConnectionReuse);
+			if (opts.noVUConnectionReuse !== null) throw new Error('unexpected noVUConnectionReuse: '+opts.noVUConnectionReuse);
+			if (opts.userAgent !== 'test-agent/1.0') throw new Error('unexpected userAgent: '+opts.userAgent);
+			if (opts.maxRedirects !== 3) throw new Error('unexpected maxRedirects: '+opts.maxRedirects);
+			if (opts.discardResponseBodies !== true) throw new Error('unexpected discardResponseBodies: '+opts.discardResponseBodies);
+			if (opts.vus !== null) throw new Error('unexpected vus: '+opts.vus);
+			if (opts.duration !== null) throw new Error('unexpected duration: '+opts.duration);
+			if (opts.iterations !== null) throw new Error('unexpected iterations: '+opts.iterations);
+			if (opts.summaryTrendStats !== null) throw new Error('unexpected summaryTrendStats: '+opts.summaryTrendStats);
+		}`},
+		{name: "test_options_shortcuts", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			vus: 2, duration: '1m30s', iterations: 10,
+			summaryTrendStats: ['avg', 'p(99)'],
+			thresholds: {
+				http_req_duration: ['p(95)<500', { threshold: 'p(99)<1000', abortOnFail: true, delayAbortEval: '10s' }],
+			},
+		};
+
+		exports.default = function() {
+			var opts = exec.test.options;
+			if (opts.vus !== 2) throw new Error('unexpected vus: '+opts.vus);
+			if (opts.discardResponseBodies !== null) throw new Error('unexpected discardResponseBodies: '+opts.discardResponseBodies);
+			if (opts.userAgent !== null) throw new Error('unexpected userAgent: '+opts.userAgent);
+			if (opts.maxRedirects !== null) throw new Error('unexpected maxRedirects: '+opts.maxRedirects);
+			if (opts.batch !== null) throw new Error('unexpected batch: '+opts.batch);
+			if (opts.batchPerHost !== null) throw new Error('unexpected batchPerHost: '+opts.batchPerHost);
+			if (opts.duration !== 90000) throw new Error('unexpected duration: '+opts.duration);
+			if (opts.iterations !== 10) throw new Error('unexpected iterations: '+opts.iterations);
+			var exp = [
+				{threshold: 'p(95)<500', abortOnFail: false, delayAbortEval: null},
+				{threshold: 'p(99)<1000', abortOnFail: true, delayAbortEval: 10000},
+			];
+			opts.summaryTrendStats[0] = 'changed';
+			var trendStats = exec.test.options.summaryTrendStats.join(',');
+			if (trendStats !== 'avg,p(99)') throw new Error('unexpected summaryTrendStats: '+trendStats);
+			var ths = opts.thresholds.http_req_duration;
+			if (Object.keys(opts.thresholds).length !== 1 || ths.length !== exp.length) {
+				throw new Error('unexpected thresholds: '+JSON.stringify(opts.thresholds));
+			}
+			for (var i = 0; i < exp.length; i++) {
+				for (var k in exp[i]) {
+					if (ths[i][k] !== exp[i][k]) throw new Error('unexpected threshold '+k+': '+JSON.stringify(ths[i]));
+				}
+			}
+		}`},
+		{name: "test_options_err", script: `
+		var exec = require('k6/x/execution');
+		exec.test;
+		`, expErr: "getting test information in the init context is not supported"},
+		{name: "publish_err", script: `
+		var exec = require('k6/x/execution');
+		exec.publish('publish_err', true);
+		`, expErr: "publishing messages in the init context is not supported"},
+		{name: "subscribe_err", script: `
+		var exec = require('k6/x/execution');
+		exec.subscribe('subscribe_err');
+		`, expErr: "subscribing to messages in the init context is not supported"},
+		{name: "claim_sequence_err", script: `
+		var exec = require('k6/x/execution');
+		exec.claimSequence('claim_sequence_err');
+		`, expErr: "claiming sequence numbers in the init context is not supported"},
+		{name: "rate_limit", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var start = Date.now();
+			for (var i = 0; i < 5; i++) {
+				exec.rateLimit('rate_limit', 20);
+			}
+			var elapsed = Date.now() - start;
+			if (elapsed < 150) throw new Error('operations were not rate limited: '+elapsed+'ms');
+		}`},
+		{name: "rate_limit_invalid", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			[0, -1, NaN, Infinity].forEach(function(rate) {
+				var err;
+				try {
+					exec.rateLimit('rate_limit_invalid', rate);
+				} catch (e) {
+					err = e;
+				}
+				if (String(err).indexOf('it must be positive and finite') < 0) throw new Error('unexpected error for '+rate+': '+err);
+			});
+		}`},
+		{name: "rate_limit_mismatch", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			exec.rateLimit('rate_limit_mismatch', 1000);
+			var err;
+			try {
+				exec.rateLimit('rate_limit_mismatch', 10);
+			} catch (e) {
+				err = e;
+			}
+			if (String(err).indexOf("rate limiter 'rate_limit_mismatch' is already used with a rate of 1000") < 0) throw new Error('unexpected error: '+err);
+		}`},
+		{name: "barrier_invalid", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var err;
+			try {
+				exec.barrier('barrier_invalid', 0);
+			} catch (e) {
+				err = e;
+			}
+			if (String(err).indexOf('it must be positive') < 0) throw new Error('unexpected error: '+err);
+			exec.barrier('barrier_single', 1);
+		}`},
+		{name: "retry_ok", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var attempts = 0;
+			var ret = exec.retry(function() {
+				attempts++;
+				if (attempts < 3) throw new Error('attempt '+attempts+' failed');
+				return 'ok';
+			}, {backoffMillis: 1});
+			if (ret !== 'ok') throw new Error('unexpected return value: '+ret);
+			if (attempts !== 3) throw new Error('unexpected attempts: '+attempts);
+		}`},
+		{name: "retry_exhausted", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var attempts = 0, err;
+			try {
+				exec.retry(function() {
+					attempts++;
+					throw new Error('attempt '+attempts+' failed');
+				}, {maxAttempts: 2, backoffMillis: 1});
+			} catch (e) {
+				err = e;
+			}
+			if (!(err instanceof Error) || err.message !== 'attempt 2 failed') throw new Error('unexpected error: '+err);
+			if (attempts !== 2) throw new Error('unexpected attempts: '+attempts);
+		}`},
+		{name: "retry_deadline", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 1, duration: '1s', gracefulStop: '0s' },
+			},
+		};
+
+		exports.default = function() {
+			var attempts = 0, err;
+			var start = Date.now();
+			try {
+				exec.retry(function() {
+					attempts++;
+					throw new Error('attempt '+attempts+' failed');
+				}, {maxAttempts: 5, backoffMillis: 2000});
+			} catch (e) {
+				err = e;
+			}
+			if (!(err instanceof Error) || err.message !== 'attempt 1 failed') throw new Error('unexpected error: '+err);
+			if (Date.now() - start > 500) throw new Error('retry waited past the deadline');
+		}`},
+		{name: "retry_deadline_long_backoff", script: `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'constant-vus', vus: 1, duration: '1s', gracefulStop: '0s' },
+			},
+		};
+
+		exports.default = function() {
+			var attempts = 0, err;
+			try {
+				exec.retry(function() {
+					attempts++;
+					throw new Error('attempt '+attempts+' failed');
+				}, {maxAttempts: 5, backoffMillis: 1e300});
+			} catch (e) {
+				err = e;
+			}
+			if (!(err instanceof Error) || err.message !== 'attempt 1 failed') throw new Error('unexpected error: '+err);
+		}`},
+		{name: "retry_invalid", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var err;
+			try {
+				exec.retry(function() {}, {maxAttempts: 0});
+			} catch (e) {
+				err = e;
+			}
+			if (String(err).indexOf('invalid maxAttempts: 0') < 0) throw new Error('unexpected error: '+err);
+		}`},
+		{name: "lifecycle_phase_init", script: `
+		var exec = require('k6/x/execution');
+		var phase = exec.lifecyclePhase();
+		if (phase !== 'init') throw new Error('unexpected lifecycle phase: '+phase);
+
+		exports.default = function() {
+			var phase = exec.lifecyclePhase();
+			if (phase !== 'main') throw new Error('unexpected lifecycle phase: '+phase);
+		}`},
+		{name: "concurrency", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			var ret = exec.concurrency('concurrency', 1, function() { return 'done'; });
+			if (ret !== 'done') throw new Error('unexpected return value: '+ret);
+			var err;
+			try {
+				exec.concurrency('concurrency', 1, function() { throw new Error('fn failed'); });
+			} catch (e) {
+				err = e;
+			}
+			if (!(err instanceof Error) || err.message !== 'fn failed') throw new Error('unexpected error: '+err);
+			// This would block if the slot wasn't released after the exception.
+			exec.concurrency('concurrency', 1, function() {});
+		}`},
+		{name: "random", script: `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			for (var i = 0; i < 100; i++) {
+				var f = exec.random();
+				if (!(f >= 0 && f < 1)) throw new Error('unexpected random(): '+f);
+				var n = exec.randomInt(-2, 2);
+				if (n < -2 || n > 2 || n !== Math.floor(n)) throw new Error('unexpected randomInt(): '+n);
+			}
+			if (exec.randomInt(5, 5) !== 5) throw new Error('unexpected randomInt() for a single value');
+			// The smallest int64 and the largest one a JS number can hold. The
+			// ranges below don't fit in an int64.
+			var min = -Math.pow(2, 63), max = Math.pow(2, 63) - 1024;
+			[[min, max], [-1024, max], [min, 0]].forEach(function(r) {
+				for (var i = 0; i < 100; i++) {
+					var n = exec.randomInt(r[0], r[1]);
+					if (n < r[0] || n > r[1]) throw new Error('unexpected randomInt('+r[0]+', '+r[1]+'): '+n);
+				}
+			});
+			if (exec.randomInt(max, max) !== max) throw new Error('unexpected randomInt() for the largest int64');
+			if (exec.randomInt(min, min) !== min) throw new Error('unexpected randomInt() for the smallest int64');
+			var err;
+			try {
+				exec.randomInt(2, 1);
+			} catch (e) {
+				err = e;
+			}
+			if (String(err).indexOf('invalid range for randomInt(): [2, 1]') < 0) throw new Error('unexpected error: '+err);
+		}`},
+		{name: "test_err", script: `
+		var exec = require('k6/x/execution');
+		exec.instance;
+		`, expErr: "getting instance information in the init context is not supported"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			r, err := getSimpleRunner(t, "/script.js", tc.script)
+			if tc.expErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expErr)
+				return
+			}
+			require.NoError(t, err)
+
+			samples := make(chan stats.SampleContainer, 100)
+			initVU, err := r.NewVU(1, 10, samples)
+			require.NoError(t, err)
+
+			execScheduler, err := local.NewExecutionScheduler(r, testutils.NewLogger(t))
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ctx = lib.WithExecutionState(ctx, execScheduler.GetState())
+			ctx = lib.WithScenarioState(ctx, &lib.ScenarioState{
+				Name:      "default",
+				Executor:  "test-exec",
+				StartTime: time.Now(),
+				ProgressFn: func() (float64, []string) {
+					return 0.1, nil
+				},
+			})
+			vu := initVU.Activate(&lib.VUActivationParams{
+				RunContext:               ctx,
+				Exec:                     "default",
+				Env:                      map[string]string{"TEST_VAR": "value"},
+				GetNextIterationCounters: func() (uint64, uint64) { return 3, 4 },
+			})
+
+			execState := execScheduler.GetState()
+			execState.ModCurrentlyActiveVUsCount(+1)
+			execState.SetExecutionStatus(lib.ExecutionStatusRunning)
+			err = vu.RunOnce()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestIterationsRemainingInScenario(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			scenarios: {
+				default: { executor: 'per-vu-iterations', vus: 1, iterations: 3 },
+			},
+		};
+
+		exports.default = function() {
+			exec.emitGauge('test_iterations_remaining', exec.vu.iterationsRemainingInScenario);
+		}`, iterations(3))
+	require.NoError(t, err)
+
+	var remaining []float64
+	for _, s := range findSamples(samples, "test_iterations_remaining") {
+		remaining = append(remaining, s.Value)
+	}
+	assert.Equal(t, []float64{2, 1, 0}, remaining)
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	t.Parallel()
+
+	_, err := runIteration(t, fmt.Sprintf(`
+		var exec = require('%s');
+
+		exports.default = function() {
+			if (exec.subscribe('publish_ok') !== undefined) throw new Error('unexpected message before publish');
+			exec.publish('publish_ok', {token: 'abc'});
+			var msg = exec.subscribe('publish_ok');
+			if (msg.token !== 'abc') throw new Error('unexpected message: '+JSON.stringify(msg));
+			msg.token = 'changed';
+			msg = exec.subscribe('publish_ok');
+			if (msg.token !== 'abc') throw new Error('message was not copied: '+JSON.stringify(msg));
+			exec.publish('publish_ok', 'def');
+			if (exec.subscribe('publish_ok') !== 'def') throw new Error('latest message was not returned');
+		}`, registerModule(t)))
+	assert.NoError(t, err)
+}
+
+func TestEmitGauge(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = { tags: { testid: 'gauge' } };
+
+		exports.default = function() {
+			exec.emitGauge('test_gauge_depth', 3);
+			exec.emitGauge('test_gauge_depth', 5, {queue: 'orders'});
+		}`)
+	require.NoError(t, err)
+
+	gs := findSamples(samples, "test_gauge_depth")
+	require.Len(t, gs, 2)
+	assert.Equal(t, stats.Gauge, gs[0].Metric.Type)
+	assert.Same(t, gs[0].Metric, gs[1].Metric)
+	assert.Equal(t, 3.0, gs[0].Value)
+	assert.Equal(t, 5.0, gs[1].Value)
+	queue, ok := gs[1].Tags.Get("queue")
+	assert.True(t, ok)
+	assert.Equal(t, "orders", queue)
+	testid, ok := gs[1].Tags.Get("testid")
+	assert.True(t, ok)
+	assert.Equal(t, "gauge", testid)
+
+	_, err = runIteration(t, `
+		var exec = require('k6/x/execution');
+		exec.emitGauge('test_gauge_init', 1);
+		exports.default = function() {}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "emitting metrics in the init context is not supported")
+}
+
+func TestAssert(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = { tags: { testid: 'assert' } };
+
+		exports.default = function() {
+			if (exec.assert(1 + 1 === 2, 'math works') !== true) throw new Error('unexpected passed result');
+			if (exec.assert(false, 'soft failure', {}) !== false) throw new Error('unexpected failed result');
+			exec.assert(false, 'hard failure', {abort: true});
+			throw new Error('the iteration was not aborted');
+		}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "assertion failed: hard failure")
+
+	as := findSamples(samples, "assertions")
+	require.Len(t, as, 3)
+	exp := []struct {
+		assertion string
+		value     float64
+	}{{"math works", 1}, {"soft failure", 0}, {"hard failure", 0}}
+	for i, e := range exp {
+		assert.Equal(t, stats.Rate, as[i].Metric.Type)
+		assert.Equal(t, e.value, as[i].Value)
+		assert.Equal(t, map[string]string{"testid": "assert", "assertion": e.assertion}, as[i].Tags.CloneTags())
+	}
+}
+
+func TestEmitHistogram(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = { tags: { testid: 'histogram' } };
+
+		exports.default = function() {
+			exec.emitHistogram('test_histogram_latency', 0.3, [0.1, 0.5, 1], {endpoint: 'login'});
+
+			var err;
+			try {
+				exec.emitHistogram('test_histogram_latency', 0.3, [0.1, 1]);
+			} catch (e) {
+				err = e;
+			}
+			if (String(err).indexOf('already registered with buckets [0.1 0.5 1]') < 0) throw new Error('unexpected error: '+err);
+
+			err = undefined;
+			try {
+				exec.emitHistogram('test_histogram_unordered', 0.3, [1, 0.5]);
+			} catch (e) {
+				err = e;
+			}
+			if (String(err).indexOf('must be in increasing order') < 0) throw new Error('unexpected error: '+err);
+		}`)
+	require.NoError(t, err)
+
+	hs := findSamples(samples, "test_histogram_latency")
+	require.Len(t, hs, 4)
+	exp := []struct {
+		le    string
+		value float64
+	}{{"0.1", 0}, {"0.5", 1}, {"1", 1}, {"+Inf", 1}}
+	for i, e := range exp {
+		assert.Equal(t, stats.Counter, hs[i].Metric.Type)
+		assert.Equal(t, e.value, hs[i].Value)
+		assert.Equal(t, map[string]string{"testid": "histogram", "endpoint": "login", "le": e.le}, hs[i].Tags.CloneTags())
+	}
+}
+
+func TestEffectiveTagsScenario(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = {
+			systemTags: ['scenario'],
+			scenarios: {
+				default: { executor: 'per-vu-iterations', tags: { scenario: 'custom' } },
+			},
+		};
+
+		exports.default = function() {
+			var tags = exec.scenario.effectiveTags;
+			if (tags.scenario !== 'default') throw new Error('unexpected scenario tag: '+tags.scenario);
+			exec.emitGauge('test_effective_tags_scenario', 1);
+		}`)
+	require.NoError(t, err)
+
+	// The scenario system tag overrides a scenario tag with the same name,
+	// both in effectiveTags and in the tags of the emitted metrics.
+	gs := findSamples(samples, "test_effective_tags_scenario")
+	require.Len(t, gs, 1)
+	tag, ok := gs[0].Tags.Get("scenario")
+	require.True(t, ok)
+	assert.Equal(t, "default", tag)
+}
+
+func TestGroupTag(t *testing.T) {
+	t.Parallel()
+
+	script := `
+		var exec = require('k6/x/execution');
+		var group = require('k6').group;
+
+		exports.options = { systemTags: %s };
+
+		exports.default = function() {
+			exec.emitGauge('test_group_tag', 1);
+			group('checkout', function() {
+				exec.emitGauge('test_group_tag', 2);
+			});
+		}`
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+		samples, err := runIteration(t, fmt.Sprintf(script, `['group']`))
+		require.NoError(t, err)
+
+		gs := findSamples(samples, "test_group_tag")
+		require.Len(t, gs, 2)
+		assert.Equal(t, map[string]string{"group": ""}, gs[0].Tags.CloneTags())
+		assert.Equal(t, map[string]string{"group": "::checkout"}, gs[1].Tags.CloneTags())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		samples, err := runIteration(t, fmt.Sprintf(script, `[]`))
+		require.NoError(t, err)
+
+		gs := findSamples(samples, "test_group_tag")
+		require.Len(t, gs, 2)
+		for _, s := range gs {
+			assert.Empty(t, s.Tags.CloneTags())
+		}
+	})
+}
+
+func TestVUTagsCopy(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = { tags: { testid: 'copy' } };
+
+		exports.default = function() {
+			var tags = exec.vu.tags;
+			tags.testid = 'changed';
+			tags.extra = 'value';
+			exec.emitGauge('test_vu_tags_copy', 1);
+		}`)
+	require.NoError(t, err)
+
+	gs := findSamples(samples, "test_vu_tags_copy")
+	require.Len(t, gs, 1)
+	assert.Equal(t, map[string]string{"testid": "copy"}, gs[0].Tags.CloneTags())
+}
+
+// Ensure that reading the VU tags while the VUs emit metrics doesn't race with
+// the processing of the samples. Run with -race.
+func TestVUTagsConcurrent(t *testing.T) {
+	t.Parallel()
+	script := []byte(fmt.Sprintf(`
+		import exec from '%s';
+
+		export let options = {
+			tags: { testid: 'concurrent' },
+			scenarios: {
+				test: {
+					executor: 'shared-iterations',
+					vus: 4,
+					iterations: 40,
+				},
+			},
+		};
+		export default function () {
+			for (var i = 0; i < 10; i++) {
+				var tags = exec.vu.tags;
+				tags.step = 'changed';
+				exec.emitGauge('test_vu_tags_concurrent', i);
+				exec.withTags({ step: 'step' + i }, function() {
+					exec.emitGauge('test_vu_tags_concurrent', i);
+					if (exec.vu.tags.step !== 'step' + i) throw new Error('unexpected step tag: '+exec.vu.tags.step);
+				});
+			}
+		}
+`, registerModule(t)))
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	// Unlike newTestExecutionScheduler(), don't drain the samples in the
+	// background, so that the test is their only reader.
+	opts, err := executor.DeriveScenariosFromShortcuts(runner.GetOptions())
+	require.NoError(t, err)
+	require.NoError(t, runner.SetOptions(opts))
+	execScheduler, err := local.NewExecutionScheduler(runner, logger)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	samples := make(chan stats.SampleContainer, 200)
+	require.NoError(t, execScheduler.Init(ctx, samples))
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	// Collect the samples while the VUs are running, then the ones that are
+	// still buffered once the run is done.
+	var collected []stats.Sample
+	timeout := time.After(10 * time.Second)
+	for running := true; running; {
+		select {
+		case sc := <-samples:
+			collected = append(collected, sc.GetSamples()...)
+		case err := <-errCh:
+			require.NoError(t, err)
+			running = false
+		case <-timeout:
+			t.Fatal("timed out")
+		}
+	}
+	for drained := false; !drained; {
+		select {
+		case sc := <-samples:
+			collected = append(collected, sc.GetSamples()...)
+		default:
+			drained = true
+		}
+	}
+
+	gs := findSamples(collected, "test_vu_tags_concurrent")
+	assert.Len(t, gs, 800)
+	for _, s := range gs {
+		if tags := s.Tags.CloneTags(); tags["testid"] != "concurrent" || tags["step"] == "changed" {
+			t.Errorf("unexpected tags: %v", tags)
+		}
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = { tags: { testid: 'with_tags' } };
+
+		exports.default = function() {
+			var ret = exec.withTags({endpoint: 'checkout'}, function() {
+				exec.emitGauge('test_with_tags', 1);
+				exec.withTags({endpoint: 'payment', step: 'card'}, function() {
+					exec.emitGauge('test_with_tags', 2);
+				});
+				exec.emitGauge('test_with_tags', 3);
+				return 'done';
+			});
+			if (ret !== 'done') throw new Error('unexpected return value: '+ret);
+
+			var err;
+			try {
+				exec.withTags({endpoint: 'failing'}, function() {
+					throw new Error('fn failed');
+				});
+			} catch (e) {
+				err = e;
+			}
+			if (!(err instanceof Error) || err.message !== 'fn failed') throw new Error('unexpected error: '+err);
+			var tags = exec.vu.tags;
+			if (Object.keys(tags).length !== 1 || tags.testid !== 'with_tags') throw new Error('tags were not restored: '+JSON.stringify(tags));
+			exec.emitGauge('test_with_tags', 4);
+		}`)
+	require.NoError(t, err)
+
+	gs := findSamples(samples, "test_with_tags")
+	require.Len(t, gs, 4)
+	assert.Equal(t, map[string]string{"testid": "with_tags", "endpoint": "checkout"}, gs[0].Tags.CloneTags())
+	assert.Equal(t, map[string]string{"testid": "with_tags", "endpoint": "payment", "step": "card"}, gs[1].Tags.CloneTags())
+	assert.Equal(t, map[string]string{"testid": "with_tags", "endpoint": "checkout"}, gs[2].Tags.CloneTags())
+	assert.Equal(t, map[string]string{"testid": "with_tags"}, gs[3].Tags.CloneTags())
+}
+
+func TestClaimSequence(t *testing.T) {
+	t.Parallel()
+
+	_, err := runIteration(t, fmt.Sprintf(`
+		var exec = require('%s');
+
+		exports.default = function() {
+			for (var i = 0; i < 3; i++) {
+				var n = exec.claimSequence('claim_sequence');
+				if (n !== i) throw new Error('unexpected sequence number: '+n);
+			}
+			var other = exec.claimSequence('claim_sequence_other');
+			if (other !== 0) throw new Error('unexpected other sequence number: '+other);
+		}`, registerModule(t)))
+	assert.NoError(t, err)
+}
+
+func TestClaimSequenceConcurrent(t *testing.T) {
+	t.Parallel()
+
+	const vus, iterations = 10, 50
+	seq := newSequences()
+	claimed := make(chan int64, vus*iterations)
+	var wg sync.WaitGroup
+	for i := 0; i < vus; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				claimed <- seq.claim("orders")
+			}
+		}()
+	}
+	wg.Wait()
+	close(claimed)
+
+	exp := make([]int64, vus*iterations)
+	got := make([]int64, 0, vus*iterations)
+	for i := range exp {
+		exp[i] = int64(i)
+	}
+	for n := range claimed {
+		got = append(got, n)
+	}
+	assert.ElementsMatch(t, exp, got)
+}
+
+func TestBarrier(t *testing.T) {
+	t.Parallel()
+
+	t.Run("release", func(t *testing.T) {
+		t.Parallel()
+
+		const parties, rounds = 5, 3
+		b := newBarriers()
+		errs := make(chan error, parties*rounds)
+		var wg sync.WaitGroup
+		for i := 0; i < parties; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < rounds; j++ {
+					errs <- b.wait(context.Background(), "burst", parties, 5*time.Second)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+
+		b := newBarriers()
+		err := b.wait(context.Background(), "burst", 2, 50*time.Millisecond)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "barrier 'burst' timed out after 50ms")
+
+		// The party that timed out shouldn't count towards the next round.
+		err = b.wait(context.Background(), "burst", 2, 50*time.Millisecond)
+		require.Error(t, err)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+
+		b := newBarriers()
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		err := b.wait(ctx, "burst", 2, 0)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("parties_mismatch", func(t *testing.T) {
+		t.Parallel()
+
+		b := newBarriers()
+		require.NoError(t, b.wait(context.Background(), "burst", 1, 0))
+		err := b.wait(context.Background(), "burst", 2, 0)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "barrier 'burst' is already used with 1 parties")
+	})
+}
+
+func TestSemaphore(t *testing.T) {
+	t.Parallel()
+
+	t.Run("limit", func(t *testing.T) {
+		t.Parallel()
+
+		const vus, limit = 10, 3
+		s := newSemaphores()
+		var mu sync.Mutex
+		var current, peak int
+		var wg sync.WaitGroup
+		for i := 0; i < vus; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := s.acquire(context.Background(), "db", limit)
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				current++
+				if current > peak {
+					peak = current
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				current--
+				mu.Unlock()
+				release()
+			}()
+		}
+		wg.Wait()
+		assert.LessOrEqual(t, peak, limit)
+	})
+
+	t.Run("limit_mismatch", func(t *testing.T) {
+		t.Parallel()
+
+		s := newSemaphores()
+		release, err := s.acquire(context.Background(), "db", 2)
+		require.NoError(t, err)
+		defer release()
+
+		_, err = s.acquire(context.Background(), "db", 3)
+		assert.EqualError(t, err, "semaphore 'db' is already used with a limit of 2")
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+
+		s := newSemaphores()
+		release, err := s.acquire(context.Background(), "db", 1)
+		require.NoError(t, err)
+		defer release()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err = s.acquire(ctx, "db", 1)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestOnces(t *testing.T) {
+	t.Parallel()
+
+	const vus = 5
+	o := newOnces()
+	fnErr := errors.New("init failed")
+	var calls int64
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := o.do(context.Background(), "test", func() error {
+			atomic.AddInt64(&calls, 1)
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			return fnErr
+		})
+		assert.Equal(t, fnErr, err)
+	}()
+	<-started
+	for i := 1; i < vus; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := o.do(context.Background(), "test", func() error {
+				atomic.AddInt64(&calls, 1)
+				return nil
+			})
+			// The waiters must not continue as if the first call succeeded.
+			assert.Equal(t, fnErr, err)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, calls)
+}
+
+func TestRandomReproducible(t *testing.T) {
+	t.Parallel()
+
+	script := `
+		var exec = require('k6/x/execution');
+
+		exports.default = function() {
+			exec.emitGauge('test_random', exec.random());
+			exec.emitGauge('test_random', exec.randomInt(0, 1000000));
+		}`
+	values := func() []float64 {
+		samples, err := runIteration(t, script)
+		require.NoError(t, err)
+		var vs []float64
+		for _, s := range findSamples(samples, "test_random") {
+			vs = append(vs, s.Value)
+		}
+		return vs
+	}
+
+	first := values()
+	require.Len(t, first, 2)
+	assert.Equal(t, first, values())
+}
+
+// Ensure that all the modules that import the execution module on a VU draw
+// from the same generator, rather than repeating the same sequence.
+func TestRandomSharedBetweenModules(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/lib.js", []byte(`
+		var exec = require('k6/x/execution');
+		exports.random = function() { return exec.random(); };
+	`), 0o644))
+
+	values := func(script string) []float64 {
+		samples, err := runIteration(t, script, fs)
+		require.NoError(t, err)
+		var vs []float64
+		for _, s := range findSamples(samples, "test_random_shared") {
+			vs = append(vs, s.Value)
+		}
+		return vs
+	}
+
+	shared := values(`
+		var exec = require('k6/x/execution');
+		var lib = require('./lib.js');
+
+		exports.default = function() {
+			exec.emitGauge('test_random_shared', exec.random());
+			exec.emitGauge('test_random_shared', lib.random());
+		}`)
+	single := values(`
 		var exec = require('k6/x/execution');
 
 		exports.default = function() {
-			if (exec.vu.idInInstance !== 1) throw new Error('unexpected VU ID: '+exec.vu.idInInstance);
-			if (exec.vu.idInTest !== 10) throw new Error('unexpected global VU ID: '+exec.vu.idInTest);
-			if (exec.vu.iterationInInstance !== 0) throw new Error('unexpected VU iteration: '+exec.vu.iterationInInstance);
-			if (exec.vu.iterationInScenario !== 0) throw new Error('unexpected scenario iteration: '+exec.vu.iterationInScenario);
-		}`},
-		{name: "vu_err", script: `
+			exec.emitGauge('test_random_shared', exec.random());
+			exec.emitGauge('test_random_shared', exec.random());
+		}`)
+	require.Len(t, shared, 2)
+	assert.NotEqual(t, shared[0], shared[1])
+	assert.Equal(t, single, shared)
+}
+
+// Ensure that all the modules that import the execution module on a VU report
+// the same creation time for it.
+func TestVUCreatedAtAcrossModules(t *testing.T) {
+	t.Parallel()
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/lib.js", []byte(`
 		var exec = require('k6/x/execution');
-		exec.vu;
-		`, expErr: "getting VU information in the init context is not supported"},
-		{name: "scenario_ok", script: `
+		exports.createdAt = function() { return exec.vu.createdAt; };
+	`), 0o644))
+
+	_, err := runIteration(t, `
 		var exec = require('k6/x/execution');
 		var sleep = require('k6').sleep;
+		sleep(0.05);
+		var lib = require('./lib.js');
 
 		exports.default = function() {
-			var si = exec.scenario;
+			if (lib.createdAt() !== exec.vu.createdAt) {
+				throw new Error('unexpected createdAt: '+lib.createdAt()+' != '+exec.vu.createdAt);
+			}
+		}`, fs)
+	require.NoError(t, err)
+}
+
+func TestPhases(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.WarnLevel}}
+	logger.AddHook(&logHook)
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+		var sleep = require('k6').sleep;
+
+		exports.default = function() {
+			exec.beginPhase('checkout');
+			exec.beginPhase('payment');
 			sleep(0.1);
-			if (si.name !== 'default') throw new Error('unexpected scenario name: '+si.name);
-			if (si.executor !== 'test-exec') throw new Error('unexpected executor: '+si.executor);
-			if (si.startTime > new Date().getTime()) throw new Error('unexpected startTime: '+si.startTime);
-			if (si.progress !== 0.1) throw new Error('unexpected progress: '+si.progress);
-			if (si.iterationInInstance !== 3) throw new Error('unexpected scenario local iteration: '+si.iterationInInstance);
-			if (si.iterationInTest !== 4) throw new Error('unexpected scenario local iteration: '+si.iterationInTest);
-		}`},
-		{name: "scenario_err", script: `
+			exec.endPhase('payment');
+			exec.beginPhase('unended');
+			exec.endPhase('checkout');
+			exec.endPhase('login');
+		}`, logger)
+	require.NoError(t, err)
+
+	payment := findSamples(samples, "phase_payment_duration")
+	require.Len(t, payment, 1)
+	assert.Equal(t, stats.Trend, payment[0].Metric.Type)
+	assert.Equal(t, stats.Time, payment[0].Metric.Contains)
+	assert.GreaterOrEqual(t, payment[0].Value, 100.0)
+
+	checkout := findSamples(samples, "phase_checkout_duration")
+	require.Len(t, checkout, 1)
+	assert.GreaterOrEqual(t, checkout[0].Value, payment[0].Value)
+	assert.Empty(t, findSamples(samples, "phase_unended_duration"))
+
+	entries := logHook.Drain()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "phase 'unended' was not ended before its parent phase 'checkout'", entries[0].Message)
+	assert.Equal(t, "endPhase('login') called without a matching beginPhase()", entries[1].Message)
+}
+
+// Ensure that a phase started in one module can be ended in another, since
+// they run on the same VU.
+func TestPhasesAcrossModules(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.WarnLevel}}
+	logger.AddHook(&logHook)
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/lib.js", []byte(`
 		var exec = require('k6/x/execution');
-		exec.scenario;
-		`, expErr: "getting scenario information in the init context is not supported"},
-		{name: "test_ok", script: `
+		exports.endCheckout = function() { exec.endPhase('checkout'); };
+	`), 0o644))
+
+	samples, err := runIteration(t, `
 		var exec = require('k6/x/execution');
+		var lib = require('./lib.js');
 
 		exports.default = function() {
-			var ti = exec.instance;
-			if (ti.currentTestRunDuration !== 0) throw new Error('unexpected test duration: '+ti.currentTestRunDuration);
-			if (ti.vusActive !== 1) throw new Error('unexpected vusActive: '+ti.vusActive);
-			if (ti.vusInitialized !== 0) throw new Error('unexpected vusInitialized: '+ti.vusInitialized);
-			if (ti.iterationsCompleted !== 0) throw new Error('unexpected iterationsCompleted: '+ti.iterationsCompleted);
-			if (ti.iterationsInterrupted !== 0) throw new Error('unexpected iterationsInterrupted: '+ti.iterationsInterrupted);
-		}`},
-		{name: "test_err", script: `
-		var exec = require('k6/x/execution');
-		exec.instance;
-		`, expErr: "getting instance information in the init context is not supported"},
+			exec.beginPhase('checkout');
+			lib.endCheckout();
+		}`, fs, logger)
+	require.NoError(t, err)
+
+	assert.Len(t, findSamples(samples, "phase_checkout_duration"), 1)
+	assert.Empty(t, logHook.Drain())
+}
+
+// Ensure that the phases left open by iterations that threw are discarded,
+// rather than piling up on the VU.
+func TestPhasesThrowingIteration(t *testing.T) {
+	t.Parallel()
+	script := []byte(`
+		import exec from 'k6/x/execution';
+
+		export let options = {
+			scenarios: {
+				test: {
+					executor: 'per-vu-iterations',
+					vus: 1,
+					iterations: 4,
+				},
+			},
+		};
+		export default function () {
+			if (exec.vu.iterationInInstance === 3) {
+				// The phases of the previous iterations were discarded.
+				exec.endPhase('checkout');
+				return;
+			}
+			exec.beginPhase('checkout');
+			throw new Error('checkout failed');
+		}
+`)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.WarnLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		var messages []string
+		for _, entry := range logHook.Drain() {
+			messages = append(messages, entry.Message)
+		}
+		assert.Equal(t, []string{
+			"phase 'checkout' was not ended in its iteration",
+			"phase 'checkout' was not ended in its iteration",
+			"phase 'checkout' was not ended in its iteration",
+			"endPhase('checkout') called without a matching beginPhase()",
+		}, messages)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	t.Parallel()
+
+	parse := func(data string) lib.Options {
+		var opts lib.Options
+		require.NoError(t, json.Unmarshal([]byte(data), &opts))
+		return opts
+	}
+	hash := func(opts lib.Options) string {
+		h, err := configHash(opts)
+		require.NoError(t, err)
+		return h
+	}
+
+	base := hash(parse(`{"scenarios": {
+		"a": {"executor": "constant-vus", "vus": 1, "duration": "1s"},
+		"b": {"executor": "shared-iterations", "iterations": 5}
+	}, "tags": {"x": "1", "y": "2"}}`))
+	reordered := hash(parse(`{"tags": {"y": "2", "x": "1"}, "scenarios": {
+		"b": {"iterations": 5, "executor": "shared-iterations"},
+		"a": {"duration": "1s", "vus": 1, "executor": "constant-vus"}
+	}}`))
+	changed := hash(parse(`{"scenarios": {
+		"a": {"executor": "constant-vus", "vus": 2, "duration": "1s"},
+		"b": {"executor": "shared-iterations", "iterations": 5}
+	}, "tags": {"x": "1", "y": "2"}}`))
+	segmented := parse(`{"scenarios": {
+		"a": {"executor": "constant-vus", "vus": 1, "duration": "1s"},
+		"b": {"executor": "shared-iterations", "iterations": 5}
+	}, "tags": {"x": "1", "y": "2"}, "executionSegment": "0:1/2"}`)
+
+	assert.Len(t, base, 64)
+	assert.Equal(t, base, reordered)
+	assert.NotEqual(t, base, changed)
+	assert.Equal(t, base, hash(segmented))
+	assert.NotNil(t, segmented.ExecutionSegment, "configHash() modified the options")
+}
+
+func TestNextRetryWait(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 2*time.Second, nextRetryWait(time.Second))
+	wait := time.Second
+	for i := 0; i < 100; i++ {
+		wait = nextRetryWait(wait)
+		require.Positive(t, wait)
 	}
+	assert.Equal(t, maxRetryWait, wait)
+}
+
+func TestInterpolateStages(t *testing.T) {
+	t.Parallel()
 
+	stages := []executor.Stage{
+		{Duration: types.NullDurationFrom(10 * time.Second), Target: null.IntFrom(10)},
+		{Duration: types.NullDurationFrom(0), Target: null.IntFrom(20)},
+		{Duration: types.NullDurationFrom(10 * time.Second), Target: null.IntFrom(0)},
+	}
+	testCases := []struct {
+		elapsed time.Duration
+		exp     float64
+	}{
+		{0, 2},
+		{5 * time.Second, 6},
+		{10 * time.Second, 20},
+		{15 * time.Second, 10},
+		{time.Minute, 0},
+	}
 	for _, tc := range testCases {
-		tc := tc
-		t.Run(tc.name, func(t *testing.T) {
-			t.Parallel()
-			r, err := getSimpleRunner(t, "/script.js", tc.script)
-			if tc.expErr != "" {
-				require.Error(t, err)
-				assert.Contains(t, err.Error(), tc.expErr)
-				return
-			}
-			require.NoError(t, err)
+		assert.Equal(t, tc.exp, interpolateStages(2, stages, tc.elapsed), tc.elapsed)
+	}
+}
 
-			samples := make(chan stats.SampleContainer, 100)
-			initVU, err := r.NewVU(1, 10, samples)
-			require.NoError(t, err)
+func TestScenarioStatus(t *testing.T) {
+	t.Parallel()
 
-			execScheduler, err := local.NewExecutionScheduler(r, testutils.NewLogger(t))
-			require.NoError(t, err)
+	et, err := lib.NewExecutionTuple(nil, nil)
+	require.NoError(t, err)
 
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
+	constant := executor.NewConstantVUsConfig("constant")
+	constant.Duration = types.NullDurationFrom(10 * time.Second)
+	constant.GracefulStop = types.NullDurationFrom(30 * time.Second)
 
-			ctx = lib.WithExecutionState(ctx, execScheduler.GetState())
-			ctx = lib.WithScenarioState(ctx, &lib.ScenarioState{
-				Name:      "default",
-				Executor:  "test-exec",
-				StartTime: time.Now(),
-				ProgressFn: func() (float64, []string) {
-					return 0.1, nil
+	// Ramping down to 0 VUs, the executor ends with its stages, not
+	// gracefulStop after them.
+	ramping := executor.NewRampingVUsConfig("ramping")
+	ramping.GracefulRampDown = types.NullDurationFrom(0)
+	ramping.GracefulStop = types.NullDurationFrom(30 * time.Second)
+	ramping.Stages = []executor.Stage{
+		{Duration: types.NullDurationFrom(10 * time.Second), Target: null.IntFrom(10)},
+		{Duration: types.NullDurationFrom(10 * time.Second), Target: null.IntFrom(0)},
+	}
+
+	testCases := []struct {
+		cfg     lib.ExecutorConfig
+		elapsed time.Duration
+		exp     string
+	}{
+		{constant, 5 * time.Second, "running"},
+		{constant, 15 * time.Second, "gracefulStopping"},
+		{ramping, 5 * time.Second, "running"},
+		{ramping, 15 * time.Second, "running"},
+		{ramping, 25 * time.Second, "gracefulStopping"},
+	}
+	for _, tc := range testCases {
+		start := time.Now().Add(-tc.elapsed)
+		assert.Equal(t, tc.exp, scenarioStatus(tc.cfg, et, start), "%s %s", tc.cfg.GetName(), tc.elapsed)
+	}
+}
+
+func TestMetricHandles(t *testing.T) {
+	t.Parallel()
+
+	samples, err := runIteration(t, `
+		var exec = require('k6/x/execution');
+
+		exports.options = { tags: { testid: 'handles' } };
+
+		var trend = exec.newTrend('test_handles_trend', true);
+		var counter = exec.newCounter('test_handles_counter');
+		var gauge = exec.newGauge('test_handles_gauge');
+
+		exports.default = function() {
+			if (trend.name !== 'test_handles_trend') throw new Error('unexpected name: '+trend.name);
+			trend.add(12.5, {endpoint: 'checkout'});
+			counter.add(1);
+			counter.add(2);
+			gauge.add(7);
+		}`)
+	require.NoError(t, err)
+
+	trend := findSamples(samples, "test_handles_trend")
+	require.Len(t, trend, 1)
+	assert.Equal(t, stats.Trend, trend[0].Metric.Type)
+	assert.Equal(t, stats.Time, trend[0].Metric.Contains)
+	assert.Equal(t, 12.5, trend[0].Value)
+	assert.Equal(t, map[string]string{"testid": "handles", "endpoint": "checkout"}, trend[0].Tags.CloneTags())
+
+	counter := findSamples(samples, "test_handles_counter")
+	require.Len(t, counter, 2)
+	assert.Equal(t, stats.Counter, counter[0].Metric.Type)
+	assert.Equal(t, 3.0, counter[0].Value+counter[1].Value)
+
+	gauge := findSamples(samples, "test_handles_gauge")
+	require.Len(t, gauge, 1)
+	assert.Equal(t, stats.Gauge, gauge[0].Metric.Type)
+	assert.Equal(t, map[string]string{"testid": "handles"}, gauge[0].Tags.CloneTags())
+
+	_, err = runIteration(t, `
+		var exec = require('k6/x/execution');
+		exports.default = function() {
+			exec.newCounter('test_handles_vu');
+		}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "metrics must be created in the init context")
+
+	_, err = runIteration(t, `
+		var exec = require('k6/x/execution');
+		exec.newCounter('test_handles_type');
+		exec.newGauge('test_handles_type');
+		exports.default = function() {}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "metric 'test_handles_type' is already registered as a counter")
+
+	_, err = runIteration(t, `
+		var exec = require('k6/x/execution');
+		exec.newTrend('test_handles_value_type', true);
+		exec.newTrend('test_handles_value_type');
+		exports.default = function() {}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "metric 'test_handles_value_type' is already registered with time values")
+
+	_, err = runIteration(t, `
+		var exec = require('k6/x/execution');
+		try { exec.emitGauge('test_handles_init_emit', 1); } catch (e) {}
+		exec.newCounter('test_handles_init_emit');
+		exports.default = function() {}`)
+	require.NoError(t, err)
+}
+
+// Ensure that all VUs report the same scenario start time, regardless of
+// when they were activated.
+func TestScenarioStartTimeStable(t *testing.T) {
+	t.Parallel()
+	script := []byte(`
+		import { sleep } from 'k6';
+		import exec from 'k6/x/execution';
+
+		export let options = {
+			scenarios: {
+				test: {
+					executor: 'ramping-vus',
+					startVUs: 1,
+					stages: [
+						{ target: 5, duration: '500ms' },
+						{ target: 5, duration: '200ms' },
+					],
+					gracefulRampDown: '0s',
 				},
-			})
-			vu := initVU.Activate(&lib.VUActivationParams{
-				RunContext:               ctx,
-				Exec:                     "default",
-				GetNextIterationCounters: func() (uint64, uint64) { return 3, 4 },
-			})
+			},
+		};
+		export default function () {
+			console.log(JSON.stringify({startTime: exec.scenario.startTime}));
+			sleep(0.1);
+		}
+`)
 
-			execState := execScheduler.GetState()
-			execState.ModCurrentlyActiveVUsCount(+1)
-			err = vu.RunOnce()
-			assert.NoError(t, err)
-		})
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logHook := testutils.SimpleLogrusHook{HookedLevels: []logrus.Level{logrus.InfoLevel}}
+	logger.AddHook(&logHook)
+
+	runner, err := js.New(
+		logger,
+		&loader.SourceData{
+			URL:  &url.URL{Path: "/script.js"},
+			Data: script,
+		},
+		nil,
+		lib.RuntimeOptions{},
+	)
+	require.NoError(t, err)
+
+	ctx, cancel, execScheduler, samples := newTestExecutionScheduler(t, runner, logger, lib.Options{})
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- execScheduler.Run(ctx, ctx, samples) }()
+
+	type logEntry struct{ StartTime int64 }
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+		entries := logHook.Drain()
+		require.NotEmpty(t, entries)
+		startTimes := map[int64]struct{}{}
+		le := &logEntry{}
+		for _, entry := range entries {
+			err = json.Unmarshal([]byte(entry.Message), le)
+			require.NoError(t, err)
+			startTimes[le.StartTime] = struct{}{}
+		}
+		assert.Len(t, startTimes, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
 	}
 }
@@ -0,0 +1,216 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package execution
+
+import (
+	"math/big"
+	"time"
+
+	"go.k6.io/k6/lib"
+	"go.k6.io/k6/lib/executor"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/stats"
+)
+
+// maxVUs returns the maximum number of VUs the executor with the given config
+// may use on this instance: maxVUs for the arrival-rate executors, the peak
+// stage target for ramping-vus, and vus for the others.
+func maxVUs(cfg lib.ExecutorConfig, et *lib.ExecutionTuple) uint64 {
+	return lib.GetMaxPossibleVUs(cfg.GetExecutionRequirements(et))
+}
+
+// relativeWeight returns the share of the named scenario in the combined VU
+// budget of all scenarios, where the VU budget of a scenario is the maximum
+// number of VUs it may use on this instance. It returns nil if the scenario
+// isn't configured.
+func relativeWeight(scenarios lib.ScenarioConfigs, name string, et *lib.ExecutionTuple) interface{} {
+	cfg, ok := scenarios[name]
+	if !ok {
+		return nil
+	}
+	var total uint64
+	for _, sc := range scenarios {
+		total += maxVUs(sc, et)
+	}
+	if total == 0 {
+		return nil
+	}
+	return float64(maxVUs(cfg, et)) / float64(total)
+}
+
+// totalIterations returns the number of iterations the executor with the given
+// config runs on this instance, for the executors with a fixed number of
+// iterations: shared-iterations and per-vu-iterations. It returns false for
+// the other executors.
+func totalIterations(cfg lib.ExecutorConfig, et *lib.ExecutionTuple) (int64, bool) {
+	switch c := cfg.(type) {
+	case executor.SharedIterationsConfig:
+		return et.ScaleInt64(c.Iterations.Int64), true
+	case executor.PerVUIterationsConfig:
+		return et.ScaleInt64(c.VUs.Int64) * c.Iterations.Int64, true
+	default:
+		return 0, false
+	}
+}
+
+// scenarioIndex returns the 0-based position of the named scenario in the
+// order the scenarios are started in, i.e. sorted by their startTime and then
+// their name. It returns nil if the scenario isn't configured.
+func scenarioIndex(scenarios lib.ScenarioConfigs, name string) interface{} {
+	for i, cfg := range scenarios.GetSortedConfigs() {
+		if cfg.GetName() == name {
+			return i
+		}
+	}
+	return nil
+}
+
+// hardStop returns the time at which the executor with the given config will
+// interrupt any iterations still running, i.e. the end of its graceful stop
+// period, for a scenario that started at start. It returns false if the
+// executor can run indefinitely.
+func hardStop(cfg lib.ExecutorConfig, et *lib.ExecutionTuple, start time.Time) (time.Time, bool) {
+	endOffset, isFinal := lib.GetEndOffset(cfg.GetExecutionRequirements(et))
+	if !isFinal {
+		return time.Time{}, false
+	}
+	return start.Add(endOffset), true
+}
+
+// scenarioStatus returns the lifecycle status of the scenario with the given
+// config that started at start: "gracefulStopping" once its planned duration
+// is over and its iterations are only allowed to finish, and "running" before
+// that, or if it can run indefinitely.
+func scenarioStatus(cfg lib.ExecutorConfig, et *lib.ExecutionTuple, start time.Time) string {
+	endOffset, isFinal := lib.GetEndOffset(cfg.GetExecutionRequirements(et))
+	if !isFinal {
+		return "running"
+	}
+	// The executors end gracefulStop after their planned duration, except
+	// ramping-vus, which ends earlier when its VUs are ramped down to 0 by
+	// the end of its stages.
+	plannedEnd := endOffset - cfg.GetGracefulStop()
+	if c, ok := cfg.(executor.RampingVUsConfig); ok {
+		plannedEnd = 0
+		for _, st := range c.Stages {
+			plannedEnd += time.Duration(st.Duration.Duration)
+		}
+	}
+	if plannedEnd > endOffset {
+		plannedEnd = endOffset
+	}
+	if !time.Now().Before(start.Add(plannedEnd)) {
+		return "gracefulStopping"
+	}
+	return "running"
+}
+
+// effectiveTags returns the tags applied to the metrics of the named scenario:
+// the run tags, overridden by the scenario tags, and the scenario system tag
+// if it's enabled.
+func effectiveTags(opts lib.Options, name string) map[string]string {
+	tags := opts.RunTags.CloneTags()
+	if cfg, ok := opts.Scenarios[name]; ok {
+		for k, v := range cfg.GetTags() {
+			tags[k] = v
+		}
+	}
+	if opts.SystemTags.Has(stats.TagScenario) {
+		tags["scenario"] = name
+	}
+	return tags
+}
+
+// currentTarget returns what the executor with the given config is aiming for
+// at elapsed time since the start of its scenario, along with the unit of that
+// value: the number of VUs ("vus") for the VU-based executors, or the
+// iterations per second ("rps") for the arrival-rate ones. Both values are
+// scaled for the execution segment of this instance. It returns nil values
+// for the externally-controlled executor, which has no target.
+func currentTarget(cfg lib.ExecutorConfig, et *lib.ExecutionTuple, elapsed time.Duration) (interface{}, interface{}) {
+	switch c := cfg.(type) {
+	case executor.ConstantVUsConfig:
+		return et.ScaleInt64(c.VUs.Int64), "vus"
+	case executor.SharedIterationsConfig:
+		return et.ScaleInt64(c.VUs.Int64), "vus"
+	case executor.PerVUIterationsConfig:
+		return et.ScaleInt64(c.VUs.Int64), "vus"
+	case executor.RampingVUsConfig:
+		vus := interpolateStages(c.StartVUs.Int64, c.Stages, elapsed)
+		return et.ScaleInt64(int64(vus)), "vus"
+	case *executor.ConstantArrivalRateConfig:
+		return scaledRatePerSec(et, float64(c.Rate.Int64), c.TimeUnit), "rps"
+	case *executor.RampingArrivalRateConfig:
+		rate := interpolateStages(c.StartRate.Int64, c.Stages, elapsed)
+		return scaledRatePerSec(et, rate, c.TimeUnit), "rps"
+	default:
+		return nil, nil
+	}
+}
+
+// interpolateStages returns the target of stages at elapsed time, linearly
+// interpolated between the targets of consecutive stages, the first one
+// starting from start. After the last stage, its target is returned.
+func interpolateStages(start int64, stages []executor.Stage, elapsed time.Duration) float64 {
+	from := float64(start)
+	for _, st := range stages {
+		duration := time.Duration(st.Duration.Duration)
+		to := float64(st.Target.Int64)
+		if elapsed < duration {
+			return from + (to-from)*float64(elapsed)/float64(duration)
+		}
+		elapsed -= duration
+		from = to
+	}
+	return from
+}
+
+// scaledRatePerSec converts rate iterations per timeUnit to iterations per
+// second, scaled for the execution segment of this instance.
+func scaledRatePerSec(et *lib.ExecutionTuple, rate float64, timeUnit types.NullDuration) float64 {
+	perSec := new(big.Rat).SetFloat64(rate * float64(time.Second) / float64(timeUnit.Duration))
+	scaled, _ := et.Segment.InPlaceScaleRat(perSec).Float64()
+	return scaled
+}
+
+// launchTime returns the time the executors were launched at, given the state
+// of a scenario that is running. The executors are all launched together once
+// setup() is done and each one waits for its startTime, so the launch time is
+// the start time of ss without its startTime offset.
+func launchTime(scenarios lib.ScenarioConfigs, ss *lib.ScenarioState) time.Time {
+	if cfg, ok := scenarios[ss.Name]; ok {
+		return ss.StartTime.Add(-cfg.GetStartTime())
+	}
+	return ss.StartTime
+}
+
+// startedScenarios returns the number of scenarios with work on this instance
+// that have started, given the state of a scenario that is running.
+func startedScenarios(scenarios lib.ScenarioConfigs, et *lib.ExecutionTuple, ss *lib.ScenarioState) int {
+	elapsed := time.Since(launchTime(scenarios, ss))
+	var started int
+	for _, cfg := range scenarios {
+		if cfg.HasWork(et) && cfg.GetStartTime() <= elapsed {
+			started++
+		}
+	}
+	return started
+}
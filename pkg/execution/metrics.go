@@ -0,0 +1,293 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package execution
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+
+	"go.k6.io/k6/js/common"
+	"go.k6.io/k6/lib"
+	"go.k6.io/k6/stats"
+)
+
+// metricRegistry keeps the custom metrics emitted through the module, so that
+// all VUs on the instance push samples for the same *stats.Metric.
+type metricRegistry struct {
+	mu         sync.Mutex
+	metrics    map[string]*stats.Metric
+	histograms map[string][]float64
+}
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{
+		metrics:    make(map[string]*stats.Metric),
+		histograms: make(map[string][]float64),
+	}
+}
+
+// get returns the metric with the given name, creating it if it doesn't exist
+// yet. It returns an error if the metric exists with a different type or value
+// type.
+func (r *metricRegistry) get(name string, typ stats.MetricType, vt ...stats.ValueType) (*stats.Metric, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		if m.Type != typ {
+			return nil, fmt.Errorf("metric '%s' is already registered as a %s", name, m.Type)
+		}
+		want := stats.Default
+		if len(vt) > 0 {
+			want = vt[0]
+		}
+		if m.Contains != want {
+			return nil, fmt.Errorf("metric '%s' is already registered with %s values", name, m.Contains)
+		}
+		return m, nil
+	}
+	m := stats.New(name, typ, vt...)
+	r.metrics[name] = m
+	return m, nil
+}
+
+// histogram returns the Counter metric of the named histogram, creating it
+// with the given bucket upper bounds if it doesn't exist yet. It returns an
+// error if the histogram exists with different buckets.
+func (r *metricRegistry) histogram(name string, buckets []float64) (*stats.Metric, error) {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return nil, fmt.Errorf("buckets of histogram '%s' must be in increasing order", name)
+		}
+	}
+	m, err := r.get(name, stats.Counter)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	layout, ok := r.histograms[name]
+	if !ok {
+		r.histograms[name] = append([]float64(nil), buckets...)
+		return m, nil
+	}
+	if len(layout) != len(buckets) {
+		return nil, fmt.Errorf("histogram '%s' is already registered with buckets %v", name, layout)
+	}
+	for i := range layout {
+		if layout[i] != buckets[i] {
+			return nil, fmt.Errorf("histogram '%s' is already registered with buckets %v", name, layout)
+		}
+	}
+	return m, nil
+}
+
+// phase is a named phase started with exec.beginPhase().
+type phase struct {
+	name  string
+	start time.Time
+}
+
+// emitGauge pushes value as the latest value of the named Gauge metric.
+func (mi *ModuleInstance) emitGauge(name string, value float64, tags map[string]string) {
+	mi.emit(name, stats.Gauge, stats.Default, value, tags)
+}
+
+// emitHistogram records value in the named histogram with the given bucket
+// upper bounds. Like Prometheus histograms, the buckets are cumulative: a
+// sample is pushed to the histogram Counter for every bucket, tagged with its
+// upper bound as le, with a value of 1 if value falls into the bucket and 0
+// otherwise. The le="+Inf" bucket counts all values.
+func (mi *ModuleInstance) emitHistogram(name string, value float64, buckets []float64, tags map[string]string) {
+	mi.checkEmitState()
+	m, err := mi.root.metrics.histogram(name, buckets)
+	if err != nil {
+		common.Throw(mi.GetRuntime(), err)
+	}
+
+	bucketTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		bucketTags[k] = v
+	}
+	for _, b := range buckets {
+		var inBucket float64
+		if value <= b {
+			inBucket = 1
+		}
+		bucketTags["le"] = strconv.FormatFloat(b, 'f', -1, 64)
+		mi.push(m, inBucket, bucketTags)
+	}
+	bucketTags["le"] = "+Inf"
+	mi.push(m, 1, bucketTags)
+}
+
+// assert pushes the result of an assertion to the assertions Rate metric,
+// tagged with its message, and returns it. If the assertion failed and the
+// abort option is set, it throws an error to interrupt the iteration.
+func (mi *ModuleInstance) assert(condition bool, message string, options goja.Value) bool {
+	rt := mi.GetRuntime()
+	var abort bool
+	if !isNullish(options) {
+		if v := options.ToObject(rt).Get("abort"); v != nil {
+			abort = v.ToBoolean()
+		}
+	}
+
+	var value float64
+	if condition {
+		value = 1
+	}
+	mi.emit("assertions", stats.Rate, stats.Default, value, map[string]string{"assertion": message})
+
+	if !condition && abort {
+		common.Throw(rt, fmt.Errorf("assertion failed: %s", message))
+	}
+	return condition
+}
+
+// beginPhase starts timing the named phase. Phases can be nested.
+func (mi *ModuleInstance) beginPhase(name string) {
+	state := mi.GetState()
+	if state == nil {
+		common.Throw(mi.GetRuntime(), errors.New("starting a phase in the init context is not supported"))
+	}
+	phases := mi.openPhases(state)
+	mi.vu.phases = append(phases, phase{name: name, start: time.Now()})
+}
+
+// endPhase ends the innermost phase with the given name and emits its duration
+// to the phase_<name>_duration Trend metric. Any phases nested in it that
+// weren't ended are discarded with a warning.
+func (mi *ModuleInstance) endPhase(name string) {
+	state := mi.GetState()
+	if state == nil {
+		common.Throw(mi.GetRuntime(), errors.New("ending a phase in the init context is not supported"))
+	}
+
+	end := time.Now()
+	phases := mi.openPhases(state)
+	i := len(phases) - 1
+	for i >= 0 && phases[i].name != name {
+		i--
+	}
+	if i < 0 {
+		state.Logger.Warnf("endPhase('%s') called without a matching beginPhase()", name)
+		return
+	}
+	for _, p := range phases[i+1:] {
+		state.Logger.Warnf("phase '%s' was not ended before its parent phase '%s'", p.name, name)
+	}
+	p := phases[i]
+	mi.vu.phases = phases[:i]
+
+	mi.emit("phase_"+name+"_duration", stats.Trend, stats.Time, stats.D(end.Sub(p.start)), nil)
+}
+
+// openPhases returns the phases of the VU that are still open in its current
+// iteration. Phases left open by a previous iteration, e.g. because it threw,
+// are discarded with a warning.
+func (mi *ModuleInstance) openPhases(state *lib.State) []phase {
+	if mi.vu.phasesIteration != state.Iteration {
+		for _, p := range mi.vu.phases {
+			state.Logger.Warnf("phase '%s' was not ended in its iteration", p.name)
+		}
+		mi.vu.phases = nil
+		mi.vu.phasesIteration = state.Iteration
+	}
+	return mi.vu.phases
+}
+
+// newMetricConstructor returns a JS function that creates a metric of the
+// given type, returning a handle whose add() method pushes samples tagged with
+// the current VU tags. Metrics can only be created in the init context.
+func (mi *ModuleInstance) newMetricConstructor(typ stats.MetricType) func(string, ...bool) *goja.Object {
+	return func(name string, isTime ...bool) *goja.Object {
+		rt := mi.GetRuntime()
+		if mi.GetInitEnv() == nil {
+			common.Throw(rt, errors.New("metrics must be created in the init context"))
+		}
+
+		vt := stats.Default
+		if len(isTime) > 0 && isTime[0] {
+			vt = stats.Time
+		}
+		m, err := mi.root.metrics.get(name, typ, vt)
+		if err != nil {
+			common.Throw(rt, err)
+		}
+
+		o := rt.NewObject()
+		if err = o.DefineDataProperty("name", rt.ToValue(name), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_TRUE); err != nil {
+			common.Throw(rt, err)
+		}
+		add := func(value float64, tags map[string]string) { mi.push(m, value, tags) }
+		if err = o.Set("add", add); err != nil {
+			common.Throw(rt, err)
+		}
+		return o
+	}
+}
+
+// emit pushes a sample for the named metric, tagged with the current VU tags
+// and any additional tags.
+func (mi *ModuleInstance) emit(
+	name string, typ stats.MetricType, vt stats.ValueType, value float64, addTags map[string]string,
+) {
+	mi.checkEmitState()
+	m, err := mi.root.metrics.get(name, typ, vt)
+	if err != nil {
+		common.Throw(mi.GetRuntime(), err)
+	}
+	mi.push(m, value, addTags)
+}
+
+// checkEmitState throws if metrics can't be emitted, i.e. in the init context.
+// It's called before a metric is looked up, so that a rejected call doesn't
+// register the metric.
+func (mi *ModuleInstance) checkEmitState() {
+	if mi.GetState() == nil {
+		common.Throw(mi.GetRuntime(), errors.New("emitting metrics in the init context is not supported"))
+	}
+}
+
+// push pushes a sample for m, tagged with the current VU tags and any
+// additional tags.
+func (mi *ModuleInstance) push(m *stats.Metric, value float64, addTags map[string]string) {
+	mi.checkEmitState()
+	state := mi.GetState()
+
+	tags := state.CloneTags()
+	for k, v := range addTags {
+		tags[k] = v
+	}
+
+	stats.PushIfNotDone(mi.GetContext(), state.Samples, stats.Sample{
+		Time:   time.Now(),
+		Metric: m,
+		Value:  value,
+		Tags:   stats.IntoSampleTags(&tags),
+	})
+}
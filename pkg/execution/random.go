@@ -0,0 +1,74 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package execution
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"go.k6.io/k6/js/common"
+)
+
+// vuRand returns the pseudo-random number generator of the VU, creating it
+// the first time it's used. It's seeded from the UUID of the VU, so every VU
+// gets the same sequence of numbers in every test run. The generator is
+// shared by all the modules of the script that import this one.
+func (mi *ModuleInstance) vuRand() *rand.Rand {
+	if mi.vu.rand != nil {
+		return mi.vu.rand
+	}
+	state := mi.GetState()
+	if state == nil {
+		common.Throw(mi.GetRuntime(), errors.New("generating random numbers in the init context is not supported"))
+	}
+	seed := int64(binary.BigEndian.Uint64(vuUUIDBytes(state.VUIDGlobal)))
+	mi.vu.rand = rand.New(rand.NewSource(seed))
+	return mi.vu.rand
+}
+
+// random returns a pseudo-random number in [0, 1) from the generator of the
+// VU.
+func (mi *ModuleInstance) random() float64 {
+	return mi.vuRand().Float64()
+}
+
+// randomInt returns a pseudo-random integer in [min, max] from the generator
+// of the VU.
+func (mi *ModuleInstance) randomInt(min, max int64) int64 {
+	if max < min {
+		common.Throw(mi.GetRuntime(), fmt.Errorf("invalid range for randomInt(): [%d, %d]", min, max))
+	}
+	r := mi.vuRand()
+	span := uint64(max) - uint64(min)
+	if span < math.MaxInt64 {
+		return min + r.Int63n(int64(span)+1)
+	}
+	// The range doesn't fit in an int64, so draw from the full uint64 range
+	// until the value falls into it, which takes 2 tries at most on average.
+	for {
+		if v := r.Uint64(); v <= span {
+			return int64(uint64(min) + v)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package execution
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dop251/goja"
+
+	"go.k6.io/k6/js/common"
+)
+
+const (
+	defaultRetryMaxAttempts   = 3
+	defaultRetryBackoffMillis = 100
+
+	// maxRetryWait is the longest wait between retries, so that doubling the
+	// wait can't overflow.
+	maxRetryWait = time.Duration(math.MaxInt64)
+)
+
+// retryOptions are the options of exec.retry().
+type retryOptions struct {
+	maxAttempts int64
+	backoff     time.Duration
+}
+
+// parseRetryOptions returns the retry options set in the JS object v, using the
+// defaults for any that aren't set.
+func parseRetryOptions(rt *goja.Runtime, v goja.Value) (retryOptions, error) {
+	opts := retryOptions{
+		maxAttempts: defaultRetryMaxAttempts,
+		backoff:     defaultRetryBackoffMillis * time.Millisecond,
+	}
+	if isNullish(v) {
+		return opts, nil
+	}
+	obj := v.ToObject(rt)
+	if ma := obj.Get("maxAttempts"); !isNullish(ma) {
+		opts.maxAttempts = ma.ToInteger()
+		if opts.maxAttempts <= 0 {
+			return opts, fmt.Errorf("invalid maxAttempts: %d, it must be positive", opts.maxAttempts)
+		}
+	}
+	if bm := obj.Get("backoffMillis"); !isNullish(bm) {
+		ms := bm.ToFloat()
+		if !(ms >= 0) {
+			return opts, fmt.Errorf("invalid backoffMillis: %v, it must not be negative", ms)
+		}
+		opts.backoff = maxRetryWait
+		if ns := ms * float64(time.Millisecond); ns < float64(maxRetryWait) {
+			opts.backoff = time.Duration(ns)
+		}
+	}
+	return opts, nil
+}
+
+// retry calls fn until it returns without throwing, up to maxAttempts times,
+// and returns its result. The wait before each retry starts at backoffMillis
+// and doubles after every attempt. Retrying stops early, rethrowing the last
+// exception, if the wait would go past the effective deadline of the VU's
+// scenario, or if the VU context is done.
+func (mi *ModuleInstance) retry(fn goja.Callable, options goja.Value) goja.Value {
+	rt := mi.GetRuntime()
+	if mi.GetState() == nil {
+		common.Throw(rt, errors.New("retrying in the init context is not supported"))
+	}
+	if fn == nil {
+		common.Throw(rt, errors.New("retry() requires a function as its first argument"))
+	}
+	opts, err := parseRetryOptions(rt, options)
+	if err != nil {
+		common.Throw(rt, err)
+	}
+
+	ctx := mi.GetContext()
+	wait := opts.backoff
+	for attempt := int64(1); ; attempt++ {
+		ret, err := fn(goja.Undefined())
+		if err == nil {
+			return ret
+		}
+		var ex *goja.Exception
+		if !errors.As(err, &ex) {
+			// Not thrown by the script, e.g. the VU was interrupted.
+			common.Throw(rt, err)
+		}
+		if attempt >= opts.maxAttempts {
+			panic(ex)
+		}
+		if deadline, ok := mi.effectiveDeadline(); ok && wait > time.Until(deadline) {
+			panic(ex)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			panic(ex)
+		}
+		wait = nextRetryWait(wait)
+	}
+}
+
+// nextRetryWait returns the wait before the retry after one that waited wait:
+// twice as long, up to maxRetryWait.
+func nextRetryWait(wait time.Duration) time.Duration {
+	if wait > maxRetryWait/2 {
+		return maxRetryWait
+	}
+	return wait * 2
+}
+
+// isNullish returns whether v is undefined or null.
+func isNullish(v goja.Value) bool {
+	return v == nil || goja.IsUndefined(v) || goja.IsNull(v)
+}
@@ -0,0 +1,230 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sequences holds named integer sequences shared between all VUs on this k6
+// instance.
+type sequences struct {
+	mu   sync.Mutex
+	next map[string]int64
+}
+
+func newSequences() *sequences {
+	return &sequences{next: make(map[string]int64)}
+}
+
+// claim returns the next number of the named sequence, starting from 0. Every
+// number is returned exactly once.
+func (s *sequences) claim(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.next[name]
+	s.next[name] = n + 1
+	return n
+}
+
+// rateLimiters holds named token-bucket rate limiters shared between all VUs
+// on this k6 instance.
+type rateLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{limiters: make(map[string]*rate.Limiter)}
+}
+
+// get returns the named limiter, creating it with the given rate if it doesn't
+// exist yet. It returns an error if the limiter exists with a different rate.
+func (rl *rateLimiters) get(name string, opsPerSec float64) (*rate.Limiter, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	lim, ok := rl.limiters[name]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(opsPerSec), 1)
+		rl.limiters[name] = lim
+	}
+	if lim.Limit() != rate.Limit(opsPerSec) {
+		return nil, fmt.Errorf("rate limiter '%s' is already used with a rate of %v", name, float64(lim.Limit()))
+	}
+	return lim, nil
+}
+
+// barrier releases the parties waiting on it once all of them have arrived.
+// It's reusable: after a release, the next arrivals wait for a new round.
+type barrier struct {
+	parties int64
+	arrived int64
+	release chan struct{}
+}
+
+// barriers holds named barriers shared between all VUs on this k6 instance.
+type barriers struct {
+	mu       sync.Mutex
+	barriers map[string]*barrier
+}
+
+func newBarriers() *barriers {
+	return &barriers{barriers: make(map[string]*barrier)}
+}
+
+// wait blocks until parties callers have arrived at the named barrier, the
+// timeout expires or ctx is done. A timeout of 0 means no timeout. Callers
+// that stop waiting early are no longer counted as arrived.
+func (b *barriers) wait(ctx context.Context, name string, parties int64, timeout time.Duration) error {
+	b.mu.Lock()
+	br, ok := b.barriers[name]
+	if !ok {
+		br = &barrier{parties: parties, release: make(chan struct{})}
+		b.barriers[name] = br
+	}
+	if br.parties != parties {
+		b.mu.Unlock()
+		return fmt.Errorf("barrier '%s' is already used with %d parties", name, br.parties)
+	}
+	release := br.release
+	br.arrived++
+	if br.arrived == br.parties {
+		close(release)
+		br.arrived = 0
+		br.release = make(chan struct{})
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	var err error
+	select {
+	case <-release:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+		err = fmt.Errorf("barrier '%s' timed out after %s", name, timeout)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-release:
+		// The last party arrived while we were giving up.
+		return nil
+	default:
+	}
+	br.arrived--
+	return err
+}
+
+// semaphores holds named counting semaphores shared between all VUs on this
+// k6 instance.
+type semaphores struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newSemaphores() *semaphores {
+	return &semaphores{slots: make(map[string]chan struct{})}
+}
+
+// acquire blocks until one of the slots of the named semaphore is free, or ctx
+// is done, and returns a function that releases the slot. The semaphore is
+// created with limit slots if it doesn't exist yet. It returns an error if the
+// semaphore exists with a different limit.
+func (s *semaphores) acquire(ctx context.Context, name string, limit int64) (func(), error) {
+	s.mu.Lock()
+	slots, ok := s.slots[name]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		s.slots[name] = slots
+	}
+	s.mu.Unlock()
+	if int64(cap(slots)) != limit {
+		return nil, fmt.Errorf("semaphore '%s' is already used with a limit of %d", name, cap(slots))
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// once is a run-once entry, closing done once its function has returned with
+// err.
+type once struct {
+	done chan struct{}
+	err  error
+}
+
+// onces holds named run-once entries shared between all VUs on this k6
+// instance.
+type onces struct {
+	mu    sync.Mutex
+	onces map[string]*once
+}
+
+func newOnces() *onces {
+	return &onces{onces: make(map[string]*once)}
+}
+
+// do calls fn if it's the first call for the given name, and returns its error.
+// Later calls block until that first call of fn has returned and return the
+// same error, or until ctx is done. fn is never called again for the same
+// name, even if the first call failed.
+func (o *onces) do(ctx context.Context, name string, fn func() error) error {
+	o.mu.Lock()
+	entry, ok := o.onces[name]
+	if !ok {
+		entry = &once{done: make(chan struct{})}
+		o.onces[name] = entry
+	}
+	o.mu.Unlock()
+
+	if !ok {
+		defer close(entry.done)
+		entry.err = fn()
+		return entry.err
+	}
+
+	select {
+	case <-entry.done:
+		return entry.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,8 +2,11 @@ package execution
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
@@ -12,6 +15,7 @@ import (
 
 	"go.k6.io/k6/core/local"
 	"go.k6.io/k6/js"
+	"go.k6.io/k6/js/modules"
 	"go.k6.io/k6/lib"
 	"go.k6.io/k6/lib/executor"
 	"go.k6.io/k6/lib/testutils"
@@ -87,3 +91,81 @@ func newTestExecutionScheduler(
 
 	return ctx, cancel, execScheduler, samples
 }
+
+// iterations is an option for runIteration() to run the given number of
+// iterations instead of one.
+type iterations int
+
+// runIteration runs the default function of script once in a single VU, or as
+// many times as an iterations option says, and returns the metric samples
+// emitted during the iterations, along with the error of the first failed
+// iteration, if any. Any other opts are passed on to getSimpleRunner().
+func runIteration(t *testing.T, script string, opts ...interface{}) ([]stats.Sample, error) {
+	iters := iterations(1)
+	for _, o := range opts {
+		if n, ok := o.(iterations); ok {
+			iters = n
+		}
+	}
+	r, err := getSimpleRunner(t, "/script.js", script, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make(chan stats.SampleContainer, 100)
+	initVU, err := r.NewVU(1, 10, samples)
+	require.NoError(t, err)
+
+	execScheduler, err := local.NewExecutionScheduler(r, testutils.NewLogger(t))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx = lib.WithExecutionState(ctx, execScheduler.GetState())
+	ctx = lib.WithScenarioState(ctx, &lib.ScenarioState{
+		Name:       "default",
+		Executor:   "test-exec",
+		StartTime:  time.Now(),
+		ProgressFn: func() (float64, []string) { return 0, nil },
+	})
+	vu := initVU.Activate(&lib.VUActivationParams{
+		RunContext:               ctx,
+		Exec:                     "default",
+		Scenario:                 "default",
+		GetNextIterationCounters: func() (uint64, uint64) { return 0, 0 },
+	})
+	for i := iterations(0); i < iters && err == nil; i++ {
+		err = vu.RunOnce()
+	}
+
+	close(samples)
+	var result []stats.Sample
+	for sc := range samples {
+		result = append(result, sc.GetSamples()...)
+	}
+	return result, err
+}
+
+var registeredModules int64
+
+// registerModule registers a new RootModule under an import path unique to the
+// calling test run and returns the path. It's for tests that need the state
+// shared between VUs to start out empty, even when they run several times in
+// the same process, e.g. with -count.
+func registerModule(t *testing.T) string {
+	path := fmt.Sprintf("k6/x/execution/%s/%d", t.Name(), atomic.AddInt64(&registeredModules, 1))
+	modules.Register(path, New())
+	return path
+}
+
+// findSamples returns the samples of the metric with the given name.
+func findSamples(samples []stats.Sample, name string) []stats.Sample {
+	var result []stats.Sample
+	for _, s := range samples {
+		if s.Metric.Name == name {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package execution
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// vuData holds the state of a VU that must be shared by all the module
+// instances on it. k6 creates a module instance for every module of the
+// script that imports this one, but all of them run on the same runtime.
+type vuData struct {
+	// createdAt is when the first module instance on the VU was created,
+	// i.e. when the init context of the VU first imported this module while
+	// the VU was being initialized.
+	createdAt time.Time
+	rand      *rand.Rand
+
+	// phases are the phases started with exec.beginPhase() in the iteration
+	// phasesIteration that weren't ended yet, innermost last.
+	phases          []phase
+	phasesIteration int64
+}
+
+// vuRegistry holds the state of every VU on this k6 instance, keyed by the
+// runtime of the VU.
+type vuRegistry struct {
+	mu  sync.Mutex
+	vus map[*goja.Runtime]*vuData
+}
+
+func newVURegistry() *vuRegistry {
+	return &vuRegistry{vus: make(map[*goja.Runtime]*vuData)}
+}
+
+// get returns the state of the VU with the given runtime, creating it if it
+// doesn't exist yet.
+func (r *vuRegistry) get(rt *goja.Runtime) *vuData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vu, ok := r.vus[rt]
+	if !ok {
+		vu = &vuData{createdAt: time.Now()}
+		r.vus[rt] = vu
+	}
+	return vu
+}